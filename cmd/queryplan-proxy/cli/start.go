@@ -2,13 +2,16 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/queryplan-ai/queryplan-proxy/pkg/daemon"
 	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/live"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -30,6 +33,15 @@ func StartCmd(signalChan *chan os.Signal) *cobra.Command {
 				*signalChan = sigs
 			} else {
 				signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+				hups := make(chan os.Signal, 1)
+				signal.Notify(hups, syscall.SIGHUP)
+				defer signal.Stop(hups)
+				go func() {
+					for range hups {
+						daemon.TriggerSchemaCollection()
+					}
+				}()
 			}
 
 			opts := daemontypes.DaemonOpts{
@@ -37,8 +49,10 @@ func StartCmd(signalChan *chan os.Signal) *cobra.Command {
 				Token:       v.GetString("token"),
 				Environment: v.GetString("env"),
 
-				LiveConnectionURI: v.GetString("live-connection-uri"),
-				DatabaseName:      v.GetString("database-name"),
+				LiveConnectionURI:                 v.GetString("live-connection-uri"),
+				LiveConnectionURIFile:             v.GetString("live-connection-uri-file"),
+				LiveConnectionHealthCheckInterval: v.GetDuration("live-connection-health-check-interval"),
+				DatabaseName:                      v.GetString("database-name"),
 
 				DBMS:        daemontypes.DBMS(v.GetString("dbms")),
 				BindAddress: v.GetString("bind-address"),
@@ -46,12 +60,59 @@ func StartCmd(signalChan *chan os.Signal) *cobra.Command {
 
 				UpstreamAddress: v.GetString("upstream-address"),
 				UpstreamPort:    v.GetFloat64("upstream-port"),
-			}
-			go daemon.Run(ctx, opts)
 
-			<-sigs
+				TLSCertFile: v.GetString("tls-cert-file"),
+				TLSKeyFile:  v.GetString("tls-key-file"),
+
+				UpstreamTLSCAFile:     v.GetString("upstream-tls-ca-file"),
+				UpstreamTLSServerName: v.GetString("upstream-tls-server-name"),
+				UpstreamTLSSkipVerify: v.GetBool("upstream-tls-skip-verify"),
+
+				AggregateQueries: v.GetBool("aggregate-queries"),
+
+				SpoolDir:          v.GetString("spool-dir"),
+				SpoolMaxBytes:     v.GetInt64("spool-max-bytes"),
+				SpoolSegmentBytes: v.GetInt64("spool-segment-bytes"),
+
+				UploadCompression:   daemontypes.UploadCompression(v.GetString("upload-compression")),
+				MaxUploadBatchBytes: v.GetInt64("max-upload-batch-bytes"),
+
+				MetricsAddress: v.GetString("metrics-address"),
+
+				HealthAddress:            v.GetString("health-address"),
+				ReadinessMaxHeartbeatAge: v.GetDuration("readiness-max-heartbeat-age"),
+				ReadinessMaxSchemaAge:    v.GetDuration("readiness-max-schema-age"),
+				ReadinessUpstreamTimeout: v.GetDuration("readiness-upstream-timeout"),
+
+				DrainTimeout: v.GetDuration("drain-timeout"),
+
+				SchemaInterval:  v.GetDuration("schema-interval"),
+				PostgresSchemas: v.GetStringSlice("postgres-schemas"),
+			}
+			runErr := make(chan error, 1)
+			go func() {
+				runErr <- daemon.Run(ctx, opts)
+			}()
+
+			select {
+			case err := <-runErr:
+				// the proxy failed on its own, like when it can't listen
+				return err
+			case <-sigs:
+			}
 			cancel()
 
+			// the daemon drains connections and flushes queries before returning,
+			// a second signal skips that
+			select {
+			case err := <-runErr:
+				if err != nil {
+					return err
+				}
+			case <-sigs:
+				return errors.New("shutdown interrupted")
+			}
+
 			fmt.Println("queryplan-proxy stopped gracefully.")
 			return nil
 		},
@@ -64,6 +125,8 @@ func StartCmd(signalChan *chan os.Signal) *cobra.Command {
 	cmd.Flags().MarkHidden("api-url")
 
 	cmd.Flags().String("live-connection-uri", "", "Live connection URI for the database")
+	cmd.Flags().String("live-connection-uri-file", "", "File containing the live connection URI, read again on every health check so rotated credentials are picked up")
+	cmd.Flags().Duration("live-connection-health-check-interval", live.DefaultHealthCheckInterval, "How often the live connection is checked")
 	cmd.Flags().String("database-name", "", "Name of the database")
 
 	cmd.Flags().String("dbms", "", "DBMS type")
@@ -73,5 +136,33 @@ func StartCmd(signalChan *chan os.Signal) *cobra.Command {
 	cmd.Flags().String("upstream-address", "", "Address of the upstream database")
 	cmd.Flags().Int("upstream-port", 0, "Port of the upstream database")
 
+	cmd.Flags().String("tls-cert-file", "", "Certificate presented to clients that request TLS. without it, TLS sessions are passed through to the upstream and aren't inspected. for mysql, TLS is only offered to clients when the upstream offers it")
+	cmd.Flags().String("tls-key-file", "", "Private key for the TLS certificate")
+
+	cmd.Flags().String("upstream-tls-ca-file", "", "CA bundle used to verify the upstream database certificate")
+	cmd.Flags().String("upstream-tls-server-name", "", "Server name used to verify the upstream database certificate, defaults to the upstream address")
+	cmd.Flags().Bool("upstream-tls-skip-verify", false, "Skip verification of the upstream database certificate")
+
+	cmd.Flags().Bool("aggregate-queries", false, "Upload a summary per query for each interval instead of every execution")
+
+	cmd.Flags().String("spool-dir", "", "Directory to spool queries to while the API is unreachable, disabled when empty")
+	cmd.Flags().Int64("spool-max-bytes", 1<<30, "Maximum size of the spool, the oldest segments are dropped past this")
+	cmd.Flags().Int64("spool-segment-bytes", 16<<20, "Size at which the spool rotates to a new segment file")
+
+	cmd.Flags().String("upload-compression", string(daemontypes.UploadCompressionNone), "Compression for uploads to the API: none, gzip or zstd")
+	cmd.Flags().Int64("max-upload-batch-bytes", 4<<20, "Maximum size of each query upload before compression, larger flushes are split into several requests")
+
+	cmd.Flags().String("metrics-address", "", "Address to serve prometheus metrics on, like 0.0.0.0:9090. Disabled when empty")
+
+	cmd.Flags().String("health-address", "", "Address to serve /healthz and /readyz on, can be the same as the metrics address. Disabled when empty")
+	cmd.Flags().Duration("readiness-max-heartbeat-age", 0, "Not ready when queries haven't been uploaded to the API for this long. Disabled by default, so an API outage doesn't take the proxy out of service")
+	cmd.Flags().Duration("readiness-max-schema-age", 0, "Not ready when the schema hasn't been uploaded to the API for this long. Disabled by default, so an API outage doesn't take the proxy out of service")
+	cmd.Flags().Duration("readiness-upstream-timeout", 2*time.Second, "Timeout for the readiness check that connects to the upstream database")
+
+	cmd.Flags().Duration("drain-timeout", 30*time.Second, "How long to wait on shutdown for busy connections to finish before closing them")
+
+	cmd.Flags().Duration("schema-interval", 30*time.Minute, "How often to collect and upload the schema. Send SIGHUP, or POST /schema/collect on the health address with the token as a bearer token, to collect now")
+	cmd.Flags().StringSlice("postgres-schemas", []string{}, "Postgres schemas to collect, comma separated. Defaults to every schema except the system schemas")
+
 	return cmd
 }
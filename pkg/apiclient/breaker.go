@@ -0,0 +1,75 @@
+package apiclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = time.Minute
+)
+
+var (
+	ErrCircuitOpen = errors.New("api circuit breaker is open")
+)
+
+// circuitBreaker opens after threshold uploads in a row fail because the API
+// is unavailable. while open, uploads fail without calling the API. once the
+// cooldown passes a single failure opens it again, a success closes it
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+
+	return nil
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		// stay one failure away from opening, so the first call after the
+		// cooldown decides
+		b.failures = b.threshold - 1
+	}
+}
+
+// openFor opens the breaker for at least d, used when the API sends a
+// Retry-After longer than the client will wait
+func (b *circuitBreaker) openFor(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(b.openUntil) {
+		b.openUntil = until
+	}
+}
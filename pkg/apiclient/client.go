@@ -0,0 +1,252 @@
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
+)
+
+const (
+	defaultTimeout     = 30 * time.Second
+	defaultMaxAttempts = 4
+	defaultBaseBackoff = 500 * time.Millisecond
+	defaultMaxBackoff  = 15 * time.Second
+
+	maxErrorBodyLength = 4096
+)
+
+var (
+	defaultClient = New()
+)
+
+// StatusError is returned when the API responds with anything but a 200
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// IsRejected returns true when the API refused the payload itself, so
+// sending the same payload again won't help
+func IsRejected(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	switch statusErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+
+	return false
+}
+
+// Client uploads to the QueryPlan API, retrying with jittered exponential
+// backoff and failing fast while the circuit breaker is open
+type Client struct {
+	httpClient  *http.Client
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	breaker     *circuitBreaker
+}
+
+func New() *Client {
+	return &Client{
+		httpClient:  &http.Client{Timeout: defaultTimeout},
+		maxAttempts: defaultMaxAttempts,
+		baseBackoff: defaultBaseBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		breaker:     newCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown),
+	}
+}
+
+// Default returns the client shared by every upload, so they all see the
+// same circuit breaker
+func Default() *Client {
+	return defaultClient
+}
+
+// Put sends body as json to path on the API, compressed when the opts ask for it
+func (c *Client) Put(ctx context.Context, opts daemontypes.DaemonOpts, path string, body []byte) error {
+	return c.send(ctx, opts, "PUT", path, body)
+}
+
+// Post is like Put, for endpoints that record events
+func (c *Client) Post(ctx context.Context, opts daemontypes.DaemonOpts, path string, body []byte) error {
+	return c.send(ctx, opts, "POST", path, body)
+}
+
+func (c *Client) send(ctx context.Context, opts daemontypes.DaemonOpts, method string, path string, body []byte) error {
+	if err := c.breaker.allow(); err != nil {
+		metrics.UploadFailures.WithLabelValues(path).Inc()
+		return err
+	}
+
+	body, contentEncoding, err := compressBody(body, opts.UploadCompression)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = c.sendWithRetries(ctx, opts, method, path, body, contentEncoding)
+	metrics.UploadDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.UploadFailures.WithLabelValues(path).Inc()
+	}
+
+	if ctx.Err() == nil {
+		c.breaker.record(isRetryable(err))
+	}
+
+	return err
+}
+
+func (c *Client) sendWithRetries(ctx context.Context, opts daemontypes.DaemonOpts, method string, path string, body []byte, contentEncoding string) error {
+	var lastErr error
+	var retryAfter time.Duration
+
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		if attempt > 0 {
+			wait := c.backoff(attempt)
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+
+			select {
+			case <-ctx.Done():
+				return lastErr
+			case <-time.After(wait):
+			}
+		}
+
+		retryAfter, lastErr = c.do(ctx, opts, method, path, body, contentEncoding)
+		if lastErr == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || !isRetryable(lastErr) {
+			return lastErr
+		}
+
+		// the API asked for more time than we're willing to wait in this
+		// call, so stop calling it until then
+		if retryAfter > c.maxBackoff {
+			c.breaker.openFor(retryAfter)
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+func (c *Client) do(ctx context.Context, opts daemontypes.DaemonOpts, method string, path string, body []byte, contentEncoding string) (time.Duration, error) {
+	url := fmt.Sprintf("%s%s", opts.APIURL, path)
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.Token))
+
+	if opts.Environment != "" {
+		req.Header.Set("X-QueryPlan-Environment", opts.Environment)
+	}
+
+	req.Header.Set("X-QueryPlan-DBMS", string(opts.DBMS))
+	req.Header.Set("X-QueryPlan-Database", opts.DatabaseName)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// read (some of) the body so the connection can be reused
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLength))
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("read body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return parseRetryAfter(resp.Header.Get("Retry-After")), &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(respBody),
+		}
+	}
+
+	return 0, nil
+}
+
+// backoff returns a random duration up to the exponential backoff for the attempt
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := c.baseBackoff << (attempt - 1)
+	if backoff > c.maxBackoff || backoff <= 0 {
+		backoff = c.maxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// isRetryable returns true for errors that mean the API is unavailable, as
+// opposed to the API refusing the request
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+
+	switch {
+	case statusErr.StatusCode == http.StatusRequestTimeout:
+		return true
+	case statusErr.StatusCode == http.StatusTooManyRequests:
+		return true
+	case statusErr.StatusCode >= 500:
+		return true
+	}
+
+	return false
+}
+
+// parseRetryAfter accepts both forms of the header, delay seconds and an http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,93 @@
+package apiclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+)
+
+func testClient() *Client {
+	c := New()
+	c.baseBackoff = time.Millisecond
+	c.maxBackoff = 5 * time.Millisecond
+	c.breaker = newCircuitBreaker(2, time.Hour)
+	return c
+}
+
+func TestClientPut(t *testing.T) {
+	var calls atomic.Int32
+	statuses := []int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1)) - 1
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("got authorization %q", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(statuses[call%len(statuses)])
+	}))
+	defer server.Close()
+
+	opts := daemontypes.DaemonOpts{APIURL: server.URL, Token: "token"}
+
+	t.Run("Retries", func(t *testing.T) {
+		calls.Store(0)
+		statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+
+		if err := testClient().Put(context.Background(), opts, "/v1/queries", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		if calls.Load() != 3 {
+			t.Errorf("got %d calls; want 3", calls.Load())
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		calls.Store(0)
+		statuses = []int{http.StatusBadRequest}
+
+		err := testClient().Put(context.Background(), opts, "/v1/queries", []byte("{}"))
+		if !IsRejected(err) {
+			t.Fatalf("got error %v; want rejected", err)
+		}
+		if calls.Load() != 1 {
+			t.Errorf("got %d calls; want 1", calls.Load())
+		}
+	})
+
+	t.Run("Breaker", func(t *testing.T) {
+		calls.Store(0)
+		statuses = []int{http.StatusBadGateway}
+
+		c := testClient()
+		for i := 0; i < 2; i++ {
+			if err := c.Put(context.Background(), opts, "/v1/queries", []byte("{}")); err == nil {
+				t.Fatal("expected error")
+			}
+		}
+		if err := c.Put(context.Background(), opts, "/v1/queries", []byte("{}")); err != ErrCircuitOpen {
+			t.Fatalf("got error %v; want %v", err, ErrCircuitOpen)
+		}
+		if calls.Load() != int32(2*c.maxAttempts) {
+			t.Errorf("got %d calls; want %d", calls.Load(), 2*c.maxAttempts)
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("120"); d != 2*time.Minute {
+		t.Errorf("got %v; want 2m", d)
+	}
+
+	if d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d < 59*time.Minute {
+		t.Errorf("got %v; want about 1h", d)
+	}
+
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("got %v; want 0", d)
+	}
+}
@@ -0,0 +1,55 @@
+package apiclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+)
+
+var (
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderErr  error
+	zstdEncoderOnce sync.Once
+)
+
+// compressBody returns the body to send and the Content-Encoding for it
+func compressBody(body []byte, compression daemontypes.UploadCompression) ([]byte, string, error) {
+	switch compression {
+	case "", daemontypes.UploadCompressionNone:
+		return body, "", nil
+
+	case daemontypes.UploadCompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, "", fmt.Errorf("gzip body: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", fmt.Errorf("gzip body: %v", err)
+		}
+		return buf.Bytes(), "gzip", nil
+
+	case daemontypes.UploadCompressionZstd:
+		encoder, err := getZstdEncoder()
+		if err != nil {
+			return nil, "", fmt.Errorf("zstd encoder: %v", err)
+		}
+		return encoder.EncodeAll(body, nil), "zstd", nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported upload compression: %s", compression)
+}
+
+// getZstdEncoder returns an encoder shared by all uploads, EncodeAll is safe
+// for concurrent use
+func getZstdEncoder() (*zstd.Encoder, error) {
+	zstdEncoderOnce.Do(func() {
+		zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+	})
+
+	return zstdEncoder, zstdEncoderErr
+}
@@ -4,22 +4,85 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/health"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/live"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres"
 )
 
 const (
-	sendInterval = 10 * time.Second
+	sendInterval     = 10 * time.Second
+	finalSendTimeout = 15 * time.Second
 )
 
-func Run(ctx context.Context, opts types.DaemonOpts) {
+var (
+	// schemaTrigger holds at most one pending on demand schema collection
+	schemaTrigger = make(chan struct{}, 1)
+)
+
+// TriggerSchemaCollection makes the schema be collected and uploaded now,
+// instead of waiting for the interval. it doesn't wait for the collection
+func TriggerSchemaCollection() {
+	select {
+	case schemaTrigger <- struct{}{}:
+	default:
+		// one is already pending
+	}
+}
+
+// Run runs the proxy until the context is cancelled or the proxy fails. it
+// returns once connections are drained and the pending queries are sent
+func Run(ctx context.Context, opts types.DaemonOpts) error {
+	var runProxy func(context.Context, types.DaemonOpts) error
+	var processSchema func(context.Context, types.DaemonOpts, *live.Conn, <-chan struct{})
+	var openLiveConnection func(types.DaemonOpts) (*live.Conn, error)
+	switch opts.DBMS {
+	case types.Postgres:
+		runProxy, processSchema, openLiveConnection = postgres.RunProxy, postgres.ProcessSchema, postgres.OpenLiveConnection
+	case types.Mysql:
+		runProxy, processSchema, openLiveConnection = mysql.RunProxy, mysql.ProcessSchema, mysql.OpenLiveConnection
+	default:
+		return &types.ConfigError{Option: "dbms", Err: fmt.Errorf("unsupported dbms %q", opts.DBMS)}
+	}
+
+	switch opts.UploadCompression {
+	case "", types.UploadCompressionNone, types.UploadCompressionGzip, types.UploadCompressionZstd:
+	default:
+		return &types.ConfigError{Option: "upload compression", Err: fmt.Errorf("unsupported compression %q", opts.UploadCompression)}
+	}
+
+	if opts.AggregateQueries {
+		heartbeat.EnableQueryAggregation()
+	}
+
+	if opts.SpoolDir != "" {
+		if err := heartbeat.EnableSpool(opts.SpoolDir, opts.SpoolMaxBytes, opts.SpoolSegmentBytes); err != nil {
+			return &types.ConfigError{Option: "spool dir", Err: err}
+		}
+	}
+
+	liveConn, err := openLiveConnection(opts)
+	if err != nil {
+		return &types.ConfigError{Option: "live connection uri", Err: err}
+	}
+	defer liveConn.Close()
+
+	// a failed proxy stops everything else too
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := runHTTPServers(ctx, opts); err != nil {
+		return err
+	}
+
+	sendDone := make(chan struct{})
 	go func() {
+		defer close(sendDone)
 		for {
 			select {
 			case <-ctx.Done():
@@ -27,42 +90,45 @@ func Run(ctx context.Context, opts types.DaemonOpts) {
 			case <-time.After(sendInterval):
 				if err := heartbeat.SendPendingQueries(ctx, opts); err != nil {
 					log.Printf("Error sending pending queries: %v", err)
+					continue
 				}
+				health.RecordHeartbeat()
 			}
 		}
 	}()
 
-	switch opts.DBMS {
-	case types.Postgres:
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		go func() {
-			defer wg.Done()
-			postgres.ProcessSchema(ctx, opts)
-		}()
-		go func() {
-			defer wg.Done()
-			postgres.RunProxy(ctx, opts)
-		}()
-
-		wg.Wait()
-	case types.Mysql:
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		go func() {
-			defer wg.Done()
-			mysql.ProcessSchema(ctx, opts)
-		}()
-		go func() {
-			defer wg.Done()
-			mysql.RunProxy(ctx, opts)
-		}()
-
-		wg.Wait()
-	default:
-		fmt.Printf("Unsupported DBMS: %s\n", opts.DBMS)
-		os.Exit(1)
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		liveConn.Run(ctx)
+	}()
+
+	go func() {
+		defer wg.Done()
+		processSchema(ctx, opts, liveConn, schemaTrigger)
+	}()
+
+	var proxyErr error
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		proxyErr = runProxy(ctx, opts)
+	}()
+
+	wg.Wait()
+
+	// the proxies have drained, so everything they captured can be sent. the
+	// context is already cancelled, so this gets one of its own
+	<-sendDone
+
+	sendCtx, sendCancel := context.WithTimeout(context.Background(), finalSendTimeout)
+	defer sendCancel()
+
+	if err := heartbeat.SendPendingQueries(sendCtx, opts); err != nil {
+		log.Printf("Error sending pending queries on shutdown: %v", err)
 	}
+
+	return proxyErr
 }
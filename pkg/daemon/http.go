@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/health"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
+)
+
+// runHTTPServers serves metrics and health checks. they can share an address,
+// in which case both are served by the same listener
+func runHTTPServers(ctx context.Context, opts types.DaemonOpts) error {
+	muxes := map[string]*http.ServeMux{}
+	getMux := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+
+	if opts.MetricsAddress != "" {
+		getMux(opts.MetricsAddress).Handle("/metrics", metrics.Handler())
+	}
+
+	if opts.HealthAddress != "" {
+		upstreamAddress := fmt.Sprintf("%s:%v", opts.UpstreamAddress, opts.UpstreamPort)
+		thresholds := health.Thresholds{
+			MaxHeartbeatAge: opts.ReadinessMaxHeartbeatAge,
+			MaxSchemaAge:    opts.ReadinessMaxSchemaAge,
+			UpstreamTimeout: opts.ReadinessUpstreamTimeout,
+		}
+
+		mux := getMux(opts.HealthAddress)
+		mux.Handle("/healthz", health.HealthzHandler())
+		mux.Handle("/readyz", health.ReadyzHandler(upstreamAddress, thresholds))
+		mux.Handle("/schema/collect", collectSchemaHandler(opts.Token))
+	}
+
+	for address, mux := range muxes {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return fmt.Errorf("listen on %s: %v", address, err)
+		}
+
+		go func(listener net.Listener, mux *http.ServeMux) {
+			if err := serveHTTP(ctx, listener, mux); err != nil {
+				log.Printf("Error serving http on %s: %v", listener.Addr(), err)
+			}
+		}(listener, mux)
+	}
+
+	return nil
+}
+
+// serveHTTP runs a server on the listener until the context is cancelled
+func serveHTTP(ctx context.Context, listener net.Listener, handler http.Handler) error {
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Printf("Error closing http listener: %v", err)
+		}
+	}()
+
+	log.Printf("Serving http on %s", listener.Addr())
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// collectSchemaHandler triggers a schema collection, like after a migration. the
+// health address is usually reachable from the cluster, so the request has to
+// carry the API token as a bearer token. triggers that arrive while one is
+// pending are merged, so repeated requests can't queue up collections
+func collectSchemaHandler(token string) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		TriggerSchemaCollection()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
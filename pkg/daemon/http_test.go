@@ -0,0 +1,47 @@
+package daemon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCollectSchemaHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		method        string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "authorized", token: "secret", method: http.MethodPost, authorization: "Bearer secret", wantStatus: http.StatusAccepted},
+		{name: "no token header", token: "secret", method: http.MethodPost, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", method: http.MethodPost, authorization: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "no token configured", method: http.MethodPost, authorization: "Bearer ", wantStatus: http.StatusUnauthorized},
+		{name: "get", token: "secret", method: http.MethodGet, authorization: "Bearer secret", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// drain any trigger left by a previous case
+			select {
+			case <-schemaTrigger:
+			default:
+			}
+
+			r := httptest.NewRequest(test.method, "/schema/collect", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			collectSchemaHandler(test.token)(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d; want %d", w.Code, test.wantStatus)
+			}
+			if triggered := len(schemaTrigger) == 1; triggered != (test.wantStatus == http.StatusAccepted) {
+				t.Errorf("got triggered %v with status %d", triggered, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package types
+
+import (
+	"fmt"
+)
+
+// ProxyError is returned when a proxy can't start or stops accepting
+// connections. Op is what failed, like "listen" or "accept"
+type ProxyError struct {
+	DBMS    DBMS
+	Op      string
+	Address string
+	Err     error
+}
+
+func (e *ProxyError) Error() string {
+	if e.Address != "" {
+		return fmt.Sprintf("%s proxy %s %s: %v", e.DBMS, e.Op, e.Address, e.Err)
+	}
+	return fmt.Sprintf("%s proxy %s: %v", e.DBMS, e.Op, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is returned for options that can't be used
+type ConfigError struct {
+	Option string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Option, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
@@ -1,5 +1,9 @@
 package types
 
+import (
+	"time"
+)
+
 type DBMS string
 
 const (
@@ -7,6 +11,14 @@ const (
 	Mysql    DBMS = "mysql"
 )
 
+type UploadCompression string
+
+const (
+	UploadCompressionNone UploadCompression = "none"
+	UploadCompressionGzip UploadCompression = "gzip"
+	UploadCompressionZstd UploadCompression = "zstd"
+)
+
 type DaemonOpts struct {
 	APIURL      string
 	Token       string
@@ -14,12 +26,44 @@ type DaemonOpts struct {
 
 	DBMS DBMS
 
-	LiveConnectionURI string
-	DatabaseName      string
+	LiveConnectionURI                 string
+	LiveConnectionURIFile             string
+	LiveConnectionHealthCheckInterval time.Duration
+	DatabaseName                      string
 
 	BindAddress string
 	BindPort    float64
 
 	UpstreamAddress string
 	UpstreamPort    float64
+
+	TLSCertFile string
+	TLSKeyFile  string
+
+	UpstreamTLSCAFile     string
+	UpstreamTLSServerName string
+	UpstreamTLSSkipVerify bool
+
+	AggregateQueries bool
+
+	SpoolDir          string
+	SpoolMaxBytes     int64
+	SpoolSegmentBytes int64
+
+	UploadCompression   UploadCompression
+	MaxUploadBatchBytes int64
+
+	MetricsAddress string
+
+	HealthAddress            string
+	ReadinessMaxHeartbeatAge time.Duration
+	ReadinessMaxSchemaAge    time.Duration
+	ReadinessUpstreamTimeout time.Duration
+
+	DrainTimeout time.Duration
+
+	SchemaInterval time.Duration
+	// PostgresSchemas limits schema collection to these schemas, all but the
+	// system schemas when empty
+	PostgresSchemas []string
 }
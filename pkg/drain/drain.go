@@ -0,0 +1,167 @@
+package drain
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	pollInterval = 100 * time.Millisecond
+)
+
+// Group tracks the connections a proxy has accepted, so they can be drained
+// when it shuts down
+type Group struct {
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	conns map[*Conn]struct{}
+}
+
+// Conn is a tracked connection. closing it closes everything added to it
+type Conn struct {
+	group *Group
+
+	mu      sync.Mutex
+	closers []io.Closer
+	idle    func() bool
+	closed  bool
+}
+
+func NewGroup() *Group {
+	return &Group{
+		conns: map[*Conn]struct{}{},
+	}
+}
+
+// Add tracks a connection. it must be called before the connection is
+// handed to another goroutine, and Done must be called when it's finished
+func (g *Group) Add(closers ...io.Closer) *Conn {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c := &Conn{
+		group:   g,
+		closers: closers,
+	}
+
+	g.conns[c] = struct{}{}
+	g.wg.Add(1)
+
+	return c
+}
+
+func (g *Group) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.conns)
+}
+
+// Drain waits for the connections to finish, closing each one as soon as it
+// is idle. anything still open after timeout is closed. it returns the
+// number of connections that were closed while busy
+func (g *Group) Drain(timeout time.Duration) int {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		g.closeConns(false)
+
+		select {
+		case <-done:
+			return 0
+		case <-ticker.C:
+		case <-deadline:
+			closed := g.closeConns(true)
+			<-done
+			return closed
+		}
+	}
+}
+
+// closeConns closes the idle connections, or all of them when force is set,
+// and returns how many were closed
+func (g *Group) closeConns(force bool) int {
+	g.mu.Lock()
+	conns := make([]*Conn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	g.mu.Unlock()
+
+	closed := 0
+	for _, c := range conns {
+		if force || c.isIdle() {
+			if c.close() {
+				closed++
+			}
+		}
+	}
+
+	return closed
+}
+
+// AddCloser adds something to close along with the connection, like the
+// upstream connection once it's dialed
+func (c *Conn) AddCloser(closer io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		closer.Close()
+		return
+	}
+
+	c.closers = append(c.closers, closer)
+}
+
+// SetIdle sets the func that reports whether the connection can be closed
+// without interrupting a query or transaction. without one, the connection
+// is only closed when the drain times out
+func (c *Conn) SetIdle(idle func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idle = idle
+}
+
+// Done stops tracking the connection
+func (c *Conn) Done() {
+	c.group.mu.Lock()
+	delete(c.group.conns, c)
+	c.group.mu.Unlock()
+
+	c.group.wg.Done()
+}
+
+func (c *Conn) isIdle() bool {
+	c.mu.Lock()
+	idle := c.idle
+	c.mu.Unlock()
+
+	return idle != nil && idle()
+}
+
+func (c *Conn) close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	c.closed = true
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+
+	return true
+}
@@ -0,0 +1,46 @@
+package drain
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	g := NewGroup()
+
+	// each connection finishes when its pipe is closed, like a proxied connection
+	track := func(idle bool) {
+		local, remote := net.Pipe()
+		c := g.Add(local)
+		c.SetIdle(func() bool { return idle })
+
+		go func() {
+			defer c.Done()
+			remote.Read(make([]byte, 1))
+		}()
+	}
+
+	track(true)
+	track(true)
+	track(false)
+
+	start := time.Now()
+	result := make(chan int)
+	go func() {
+		result <- g.Drain(500 * time.Millisecond)
+	}()
+
+	time.Sleep(250 * time.Millisecond)
+	if g.Len() != 1 {
+		t.Fatalf("got %d connections while draining; want only the busy one", g.Len())
+	}
+
+	closed := <-result
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("busy connection was closed after %s; want the drain timeout", elapsed)
+	}
+	if closed != 1 {
+		t.Errorf("got %d connections closed while busy; want 1", closed)
+	}
+}
@@ -0,0 +1,169 @@
+package health
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a proxied connection that reached the upstream this recently is
+	// enough, so probes don't open connections to a busy database
+	recentUpstreamDial = 30 * time.Second
+)
+
+var (
+	current = &status{
+		startedAt: time.Now(),
+	}
+)
+
+// Thresholds decide when the proxy stops being ready
+type Thresholds struct {
+	// MaxHeartbeatAge is how long ago the last successful query upload can be, 0 disables the check
+	MaxHeartbeatAge time.Duration
+	// MaxSchemaAge is how long ago the last successful schema upload can be, 0 disables the check
+	MaxSchemaAge time.Duration
+	// UpstreamTimeout limits the dial used to check the upstream
+	UpstreamTimeout time.Duration
+}
+
+type status struct {
+	mu sync.Mutex
+
+	startedAt      time.Time
+	listening      bool
+	heartbeatAt    time.Time
+	schemaUploadAt time.Time
+	schemaErr      error
+	upstreamDialAt time.Time
+}
+
+// SetListening records whether the proxy listener is accepting connections
+func SetListening(listening bool) {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+
+	current.listening = listening
+}
+
+// RecordHeartbeat records a successful send of the pending queries
+func RecordHeartbeat() {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+
+	current.heartbeatAt = time.Now()
+}
+
+// RecordSchemaUpload records the result of the last schema collection and upload
+func RecordSchemaUpload(err error) {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+
+	current.schemaErr = err
+	if err == nil {
+		current.schemaUploadAt = time.Now()
+	}
+}
+
+// RecordUpstreamDial records that a client connection reached the upstream
+func RecordUpstreamDial() {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+
+	current.upstreamDialAt = time.Now()
+}
+
+// HealthzHandler succeeds while the proxy listener accepts connections
+func HealthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current.mu.Lock()
+		listening := current.listening
+		current.mu.Unlock()
+
+		if !listening {
+			http.Error(w, "listener is not accepting connections", http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// ReadyzHandler succeeds when the proxy is listening and the upstream is
+// reachable. the schema and query uploads only count when their thresholds
+// are set, since an unreachable API shouldn't take the proxy out of service
+func ReadyzHandler(upstreamAddress string, thresholds Thresholds) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		failures := checkReady(upstreamAddress, thresholds)
+		if len(failures) > 0 {
+			http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func checkReady(upstreamAddress string, thresholds Thresholds) []string {
+	current.mu.Lock()
+	s := status{
+		startedAt:      current.startedAt,
+		listening:      current.listening,
+		heartbeatAt:    current.heartbeatAt,
+		schemaUploadAt: current.schemaUploadAt,
+		schemaErr:      current.schemaErr,
+		upstreamDialAt: current.upstreamDialAt,
+	}
+	current.mu.Unlock()
+
+	now := time.Now()
+	failures := []string{}
+
+	if !s.listening {
+		failures = append(failures, "listener is not accepting connections")
+	}
+
+	if now.Sub(s.upstreamDialAt) > recentUpstreamDial {
+		conn, err := net.DialTimeout("tcp", upstreamAddress, thresholds.UpstreamTimeout)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("upstream is not reachable: %v", err))
+		} else {
+			conn.Close()
+			RecordUpstreamDial()
+		}
+	}
+
+	// the first upload happens a while after starting, so the ages count from then
+	if thresholds.MaxSchemaAge > 0 {
+		schemaUploadAt := s.schemaUploadAt
+		if schemaUploadAt.Before(s.startedAt) {
+			schemaUploadAt = s.startedAt
+		}
+		if now.Sub(schemaUploadAt) > thresholds.MaxSchemaAge {
+			failure := fmt.Sprintf("last schema upload was %s ago", now.Sub(schemaUploadAt).Round(time.Second))
+			if s.schemaUploadAt.IsZero() {
+				failure = "schema has not been uploaded"
+			}
+			if s.schemaErr != nil {
+				failure = fmt.Sprintf("%s: %v", failure, s.schemaErr)
+			}
+			failures = append(failures, failure)
+		}
+	}
+
+	if thresholds.MaxHeartbeatAge > 0 {
+		heartbeatAt := s.heartbeatAt
+		if heartbeatAt.Before(s.startedAt) {
+			heartbeatAt = s.startedAt
+		}
+		if now.Sub(heartbeatAt) > thresholds.MaxHeartbeatAge {
+			failures = append(failures, fmt.Sprintf("last query upload was %s ago", now.Sub(heartbeatAt).Round(time.Second)))
+		}
+	}
+
+	return failures
+}
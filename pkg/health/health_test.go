@@ -0,0 +1,73 @@
+package health
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckReady(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	longAgo := time.Now().Add(-3 * time.Hour)
+
+	tests := []struct {
+		name         string
+		state        *status
+		thresholds   Thresholds
+		wantFailures []string
+	}{
+		{
+			name:         "upload checks disabled",
+			state:        &status{startedAt: longAgo, listening: true, schemaErr: errors.New("api unavailable")},
+			wantFailures: []string{},
+		},
+		{
+			name:         "schema upload failing",
+			state:        &status{startedAt: longAgo, listening: true, schemaErr: errors.New("api unavailable")},
+			thresholds:   Thresholds{MaxSchemaAge: time.Hour},
+			wantFailures: []string{"schema has not been uploaded: api unavailable"},
+		},
+		{
+			name:         "schema upload failing since the last success",
+			state:        &status{startedAt: longAgo, listening: true, schemaUploadAt: time.Now().Add(-time.Minute), schemaErr: errors.New("api unavailable")},
+			thresholds:   Thresholds{MaxSchemaAge: time.Hour},
+			wantFailures: []string{},
+		},
+		{
+			name:         "just started",
+			state:        &status{startedAt: time.Now(), listening: true},
+			thresholds:   Thresholds{MaxSchemaAge: time.Hour, MaxHeartbeatAge: time.Minute},
+			wantFailures: []string{},
+		},
+		{
+			name:         "heartbeat stale",
+			state:        &status{startedAt: longAgo, listening: true, heartbeatAt: longAgo},
+			thresholds:   Thresholds{MaxHeartbeatAge: time.Minute},
+			wantFailures: []string{"last query upload was 3h0m0s ago"},
+		},
+		{
+			name:         "not listening",
+			state:        &status{startedAt: longAgo},
+			wantFailures: []string{"listener is not accepting connections"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func(previous *status) { current = previous }(current)
+			current = test.state
+
+			test.thresholds.UpstreamTimeout = time.Second
+			if failures := checkReady(upstream.Addr().String(), test.thresholds); !reflect.DeepEqual(failures, test.wantFailures) {
+				t.Errorf("got failures %q; want %q", failures, test.wantFailures)
+			}
+		})
+	}
+}
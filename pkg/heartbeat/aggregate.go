@@ -0,0 +1,216 @@
+package heartbeat
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
+)
+
+const (
+	defaultMaxAggregatedQueries = 10000
+)
+
+var (
+	// durationHistogramBounds are the upper bounds, in nanoseconds, of the
+	// latency buckets kept for each aggregated query
+	durationHistogramBounds = []int64{
+		int64(100 * time.Microsecond),
+		int64(250 * time.Microsecond),
+		int64(500 * time.Microsecond),
+		int64(1 * time.Millisecond),
+		int64(2500 * time.Microsecond),
+		int64(5 * time.Millisecond),
+		int64(10 * time.Millisecond),
+		int64(25 * time.Millisecond),
+		int64(50 * time.Millisecond),
+		int64(100 * time.Millisecond),
+		int64(250 * time.Millisecond),
+		int64(500 * time.Millisecond),
+		int64(1 * time.Second),
+		int64(2500 * time.Millisecond),
+		int64(5 * time.Second),
+		int64(10 * time.Second),
+	}
+
+	// queryAggregator is nil unless aggregation is enabled, in which case
+	// queries are summarized here instead of being added to pendingQueries
+	queryAggregator *aggregator
+)
+
+type aggregator struct {
+	mu          sync.Mutex
+	windowStart int64
+	aggregates  map[string]*types.QueryPlanQueryAggregate
+	max         int
+	dropped     int64
+}
+
+// EnableQueryAggregation makes the proxy upload a summary per cleaned query
+// for each flush window, instead of every execution
+func EnableQueryAggregation() {
+	queryAggregator = &aggregator{
+		aggregates: map[string]*types.QueryPlanQueryAggregate{},
+		max:        defaultMaxAggregatedQueries,
+	}
+}
+
+func (a *aggregator) Add(qpq types.QueryPlanQuery) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.windowStart == 0 {
+		a.windowStart = qpq.ExecutedAt
+	}
+
+	aggregate, ok := a.aggregates[qpq.Query]
+	if !ok {
+		if len(a.aggregates) >= a.max {
+			a.dropped++
+			metrics.QueriesDropped.WithLabelValues("aggregate_limit").Inc()
+			return
+		}
+
+		aggregate = &types.QueryPlanQueryAggregate{
+			Query:             qpq.Query,
+			MinDuration:       qpq.Duration,
+			MaxDuration:       qpq.Duration,
+			MinRowCount:       qpq.RowCount,
+			MaxRowCount:       qpq.RowCount,
+			DurationHistogram: make([]int64, len(durationHistogramBounds)+1),
+		}
+		a.aggregates[qpq.Query] = aggregate
+	}
+
+	aggregate.Count++
+	if qpq.Error != nil {
+		aggregate.ErrorCount++
+		addErrorCount(aggregate, qpq.Error.SQLState, qpq.Error.ErrorCode, 1)
+	}
+	if qpq.IsPreparedStatement {
+		aggregate.PreparedStatementCount++
+	}
+
+	aggregate.TotalDuration += qpq.Duration
+	aggregate.MinDuration = min(aggregate.MinDuration, qpq.Duration)
+	aggregate.MaxDuration = max(aggregate.MaxDuration, qpq.Duration)
+	aggregate.DurationHistogram[histogramBucket(qpq.Duration)]++
+
+	aggregate.TotalRowCount += qpq.RowCount
+	aggregate.MinRowCount = min(aggregate.MinRowCount, qpq.RowCount)
+	aggregate.MaxRowCount = max(aggregate.MaxRowCount, qpq.RowCount)
+}
+
+// Flush returns the aggregates for the current window and starts a new one
+func (a *aggregator) Flush() []types.QueryPlanQueryAggregate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.dropped > 0 {
+		log.Printf("Dropped %d queries, more than %d distinct queries in the window", a.dropped, a.max)
+	}
+
+	windowEnd := time.Now().UnixNano()
+	aggregates := make([]types.QueryPlanQueryAggregate, 0, len(a.aggregates))
+	for _, aggregate := range a.aggregates {
+		aggregate.WindowStart = a.windowStart
+		aggregate.WindowEnd = windowEnd
+		aggregate.P50Duration = histogramPercentile(aggregate, 0.50)
+		aggregate.P95Duration = histogramPercentile(aggregate, 0.95)
+		aggregate.P99Duration = histogramPercentile(aggregate, 0.99)
+		aggregates = append(aggregates, *aggregate)
+	}
+
+	a.aggregates = map[string]*types.QueryPlanQueryAggregate{}
+	a.windowStart = 0
+	a.dropped = 0
+
+	return aggregates
+}
+
+// Restore merges aggregates that failed to upload back in, so they go out
+// with the next flush
+func (a *aggregator) Restore(aggregates []types.QueryPlanQueryAggregate) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, restored := range aggregates {
+		if a.windowStart == 0 || restored.WindowStart < a.windowStart {
+			a.windowStart = restored.WindowStart
+		}
+
+		aggregate, ok := a.aggregates[restored.Query]
+		if !ok {
+			restored := restored
+			a.aggregates[restored.Query] = &restored
+			continue
+		}
+
+		aggregate.Count += restored.Count
+		aggregate.ErrorCount += restored.ErrorCount
+		for _, errorCount := range restored.Errors {
+			addErrorCount(aggregate, errorCount.SQLState, errorCount.ErrorCode, errorCount.Count)
+		}
+		aggregate.PreparedStatementCount += restored.PreparedStatementCount
+		aggregate.TotalDuration += restored.TotalDuration
+		aggregate.MinDuration = min(aggregate.MinDuration, restored.MinDuration)
+		aggregate.MaxDuration = max(aggregate.MaxDuration, restored.MaxDuration)
+		for i := range aggregate.DurationHistogram {
+			aggregate.DurationHistogram[i] += restored.DurationHistogram[i]
+		}
+		aggregate.TotalRowCount += restored.TotalRowCount
+		aggregate.MinRowCount = min(aggregate.MinRowCount, restored.MinRowCount)
+		aggregate.MaxRowCount = max(aggregate.MaxRowCount, restored.MaxRowCount)
+	}
+}
+
+// addErrorCount adds to the count for an error, there are only ever a few
+// distinct errors per query so a slice is enough
+func addErrorCount(aggregate *types.QueryPlanQueryAggregate, sqlState string, errorCode int, count int64) {
+	for i := range aggregate.Errors {
+		if aggregate.Errors[i].SQLState == sqlState && aggregate.Errors[i].ErrorCode == errorCode {
+			aggregate.Errors[i].Count += count
+			return
+		}
+	}
+
+	aggregate.Errors = append(aggregate.Errors, types.QueryPlanQueryErrorCount{
+		SQLState:  sqlState,
+		ErrorCode: errorCode,
+		Count:     count,
+	})
+}
+
+func histogramBucket(duration int64) int {
+	for i, bound := range durationHistogramBounds {
+		if duration <= bound {
+			return i
+		}
+	}
+
+	return len(durationHistogramBounds)
+}
+
+// histogramPercentile estimates a percentile as the upper bound of the bucket
+// that contains it, capped at the max duration that was seen
+func histogramPercentile(aggregate *types.QueryPlanQueryAggregate, percentile float64) int64 {
+	target := int64(float64(aggregate.Count)*percentile + 0.5)
+	if target < 1 {
+		target = 1
+	}
+
+	cumulative := int64(0)
+	for i, count := range aggregate.DurationHistogram {
+		cumulative += count
+		if cumulative >= target {
+			if i < len(durationHistogramBounds) {
+				return min(durationHistogramBounds[i], aggregate.MaxDuration)
+			}
+			break
+		}
+	}
+
+	return aggregate.MaxDuration
+}
@@ -0,0 +1,145 @@
+package heartbeat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+)
+
+func TestAggregator(t *testing.T) {
+	a := &aggregator{
+		aggregates: map[string]*types.QueryPlanQueryAggregate{},
+		max:        2,
+	}
+
+	for i := 1; i <= 100; i++ {
+		a.Add(types.QueryPlanQuery{
+			ExecutedAt: int64(i),
+			Query:      "select * from users where id = ?",
+			Duration:   int64(time.Duration(i) * time.Millisecond),
+			RowCount:   int64(i % 3),
+		})
+	}
+	a.Add(types.QueryPlanQuery{
+		ExecutedAt: 101,
+		Query:      "delete from users where id = ?",
+		Duration:   int64(time.Millisecond),
+		Error:      &types.QueryPlanQueryError{SQLState: "40001", ErrorCode: 1213},
+	})
+	a.Add(types.QueryPlanQuery{
+		ExecutedAt: 102,
+		Query:      "select 1 from dual",
+	})
+
+	aggregates := a.Flush()
+	if len(aggregates) != 2 {
+		t.Fatalf("got %d aggregates; want 2", len(aggregates))
+	}
+
+	byQuery := map[string]types.QueryPlanQueryAggregate{}
+	for _, aggregate := range aggregates {
+		byQuery[aggregate.Query] = aggregate
+	}
+
+	t.Run("Stats", func(t *testing.T) {
+		got := byQuery["select * from users where id = ?"]
+		if got.Count != 100 {
+			t.Fatalf("got count %d; want 100", got.Count)
+		}
+		if got.MinDuration != int64(time.Millisecond) || got.MaxDuration != int64(100*time.Millisecond) {
+			t.Fatalf("got min %d max %d", got.MinDuration, got.MaxDuration)
+		}
+		if got.TotalRowCount != 100 || got.MinRowCount != 0 || got.MaxRowCount != 2 {
+			t.Fatalf("got rows total %d min %d max %d", got.TotalRowCount, got.MinRowCount, got.MaxRowCount)
+		}
+		if got.P50Duration != int64(50*time.Millisecond) {
+			t.Fatalf("got p50 %d; want %d", got.P50Duration, int64(50*time.Millisecond))
+		}
+		if got.P99Duration != int64(100*time.Millisecond) {
+			t.Fatalf("got p99 %d; want %d", got.P99Duration, int64(100*time.Millisecond))
+		}
+		if got.WindowStart != 1 {
+			t.Fatalf("got window start %d; want 1", got.WindowStart)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		got := byQuery["delete from users where id = ?"]
+		if got.Count != 1 || got.ErrorCount != 1 {
+			t.Fatalf("got count %d errors %d; want 1 and 1", got.Count, got.ErrorCount)
+		}
+		want := []types.QueryPlanQueryErrorCount{{SQLState: "40001", ErrorCode: 1213, Count: 1}}
+		if !reflect.DeepEqual(got.Errors, want) {
+			t.Fatalf("got errors %+v; want %+v", got.Errors, want)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		a.Add(types.QueryPlanQuery{
+			ExecutedAt: 200,
+			Query:      "delete from users where id = ?",
+			Duration:   int64(time.Second),
+			Error:      &types.QueryPlanQueryError{SQLState: "40001", ErrorCode: 1213},
+		})
+		a.Restore(aggregates)
+
+		restored := a.Flush()
+		if len(restored) != 2 {
+			t.Fatalf("got %d aggregates; want 2", len(restored))
+		}
+		for _, aggregate := range restored {
+			if aggregate.Query != "delete from users where id = ?" {
+				continue
+			}
+			if aggregate.Count != 2 || aggregate.ErrorCount != 2 {
+				t.Fatalf("got count %d errors %d; want 2 and 2", aggregate.Count, aggregate.ErrorCount)
+			}
+			wantErrors := []types.QueryPlanQueryErrorCount{{SQLState: "40001", ErrorCode: 1213, Count: 2}}
+			if !reflect.DeepEqual(aggregate.Errors, wantErrors) {
+				t.Fatalf("got errors %+v; want %+v", aggregate.Errors, wantErrors)
+			}
+			want := make([]int64, len(durationHistogramBounds)+1)
+			want[histogramBucket(int64(time.Millisecond))]++
+			want[histogramBucket(int64(time.Second))]++
+			if !reflect.DeepEqual(aggregate.DurationHistogram, want) {
+				t.Fatalf("histogram mismatch\ngot: %v\nwant %v", aggregate.DurationHistogram, want)
+			}
+		}
+	})
+}
+
+func TestAggregatedTransaction(t *testing.T) {
+	defer func(a *aggregator) { queryAggregator = a }(queryAggregator)
+	EnableQueryAggregation()
+
+	currentTransaction := StartTransaction(1)
+	for i := 0; i < 3; i++ {
+		addTransactionQuery(currentTransaction, types.QueryPlanQuery{
+			Query:    "update accounts set balance = ? where id = ?",
+			Duration: 10,
+			RowCount: 1,
+		})
+	}
+	addTransactionQuery(currentTransaction, types.QueryPlanQuery{
+		Query:    "insert into ledger values (?, ?)",
+		Duration: 5,
+		Error:    &types.QueryPlanQueryError{SQLState: "23505"},
+	})
+
+	if len(currentTransaction.Queries) != 0 {
+		t.Errorf("got %d queries; want none while aggregating", len(currentTransaction.Queries))
+	}
+	if currentTransaction.QueryCount != 4 {
+		t.Errorf("got query count %d; want 4", currentTransaction.QueryCount)
+	}
+
+	want := []types.QueryPlanTransactionQuery{
+		{Query: "update accounts set balance = ? where id = ?", Count: 3, TotalDuration: 30, TotalRowCount: 3},
+		{Query: "insert into ledger values (?, ?)", Count: 1, ErrorCount: 1, TotalDuration: 5},
+	}
+	if !reflect.DeepEqual(currentTransaction.QuerySummaries, want) {
+		t.Errorf("got summaries %+v; want %+v", currentTransaction.QuerySummaries, want)
+	}
+}
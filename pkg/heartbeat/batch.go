@@ -0,0 +1,98 @@
+package heartbeat
+
+import (
+	"encoding/json"
+	"fmt"
+
+	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+)
+
+// splitPayload splits a payload into payloads that each marshal to at most
+// maxBytes. a single query or transaction that is larger than maxBytes is
+// sent in a payload of its own
+func splitPayload(payload heartbeattypes.QueryPlanQueriesPayload, maxBytes int64) ([]heartbeattypes.QueryPlanQueriesPayload, error) {
+	if maxBytes <= 0 {
+		return []heartbeattypes.QueryPlanQueriesPayload{payload}, nil
+	}
+
+	emptyBatch := func() heartbeattypes.QueryPlanQueriesPayload {
+		return heartbeattypes.QueryPlanQueriesPayload{
+			Queries:                 []heartbeattypes.QueryPlanQuery{},
+			Transactions:            []heartbeattypes.QueryPlanTransaction{},
+			DurationHistogramBounds: payload.DurationHistogramBounds,
+		}
+	}
+
+	marshaledEmpty, err := json.Marshal(emptyBatch())
+	if err != nil {
+		return nil, fmt.Errorf("marshal empty payload: %v", err)
+	}
+	// room for the aggregates key, which is omitted when empty
+	emptySize := int64(len(marshaledEmpty)) + int64(len(`,"aggregates":[]`))
+
+	batches := []heartbeattypes.QueryPlanQueriesPayload{}
+	current := emptyBatch()
+	currentSize := emptySize
+	currentCount := 0
+
+	// add starts a new batch when the item doesn't fit, each item also
+	// needs a byte for the comma that separates it from the previous one
+	add := func(item interface{}, appendItem func(*heartbeattypes.QueryPlanQueriesPayload)) error {
+		marshaled, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+
+		itemSize := int64(len(marshaled)) + 1
+		if currentCount > 0 && currentSize+itemSize > maxBytes {
+			batches = append(batches, current)
+			current = emptyBatch()
+			currentSize = emptySize
+			currentCount = 0
+		}
+
+		appendItem(&current)
+		currentSize += itemSize
+		currentCount++
+		return nil
+	}
+
+	for _, query := range payload.Queries {
+		query := query
+		if err := add(query, func(p *heartbeattypes.QueryPlanQueriesPayload) {
+			p.Queries = append(p.Queries, query)
+		}); err != nil {
+			return nil, fmt.Errorf("marshal query: %v", err)
+		}
+	}
+
+	for _, transaction := range payload.Transactions {
+		transaction := transaction
+		if err := add(transaction, func(p *heartbeattypes.QueryPlanQueriesPayload) {
+			p.Transactions = append(p.Transactions, transaction)
+		}); err != nil {
+			return nil, fmt.Errorf("marshal transaction: %v", err)
+		}
+	}
+
+	for _, aggregate := range payload.Aggregates {
+		aggregate := aggregate
+		if err := add(aggregate, func(p *heartbeattypes.QueryPlanQueriesPayload) {
+			p.Aggregates = append(p.Aggregates, aggregate)
+		}); err != nil {
+			return nil, fmt.Errorf("marshal aggregate: %v", err)
+		}
+	}
+
+	if currentCount > 0 {
+		batches = append(batches, current)
+	}
+
+	for i := range batches {
+		if len(batches[i].Aggregates) == 0 {
+			batches[i].DurationHistogramBounds = nil
+		}
+	}
+
+	return batches, nil
+}
@@ -0,0 +1,53 @@
+package heartbeat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+)
+
+func TestSplitPayload(t *testing.T) {
+	payload := types.QueryPlanQueriesPayload{
+		Transactions: []types.QueryPlanTransaction{{Outcome: types.TransactionOutcomeCommit}},
+	}
+	for i := 0; i < 100; i++ {
+		payload.Queries = append(payload.Queries, types.QueryPlanQuery{
+			Query: fmt.Sprintf("select * from table_%d where id = ?", i),
+		})
+	}
+	payload.Queries = append(payload.Queries, types.QueryPlanQuery{
+		Query: "select " + strings.Repeat("a, ", 1000) + "b from big",
+	})
+
+	maxBytes := int64(1024)
+	batches, err := splitPayload(payload, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries, transactions := 0, 0
+	for i, batch := range batches {
+		marshaled, err := json.Marshal(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		oversized := len(batch.Queries) == 1 && strings.HasSuffix(batch.Queries[0].Query, "from big")
+		if int64(len(marshaled)) > maxBytes && !oversized {
+			t.Errorf("batch %d is %d bytes; want at most %d", i, len(marshaled), maxBytes)
+		}
+
+		queries += len(batch.Queries)
+		transactions += len(batch.Transactions)
+	}
+
+	if queries != len(payload.Queries) || transactions != len(payload.Transactions) {
+		t.Errorf("got %d queries and %d transactions; want %d and %d", queries, transactions, len(payload.Queries), len(payload.Transactions))
+	}
+	if len(batches) < 2 {
+		t.Errorf("got %d batches; want the payload to be split", len(batches))
+	}
+}
@@ -1,68 +1,162 @@
 package heartbeat
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"log"
 
+	"github.com/queryplan-ai/queryplan-proxy/pkg/apiclient"
 	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
 	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/ringbuffer"
 )
 
 const (
-	defaultMaxPendingQueriesSize = 10000
+	defaultMaxPendingQueriesSize      = 10000
+	defaultMaxPendingTransactionsSize = 1000
 )
 
 var (
 	// pendingQueries is the ring buffer that are pending to send to the API
 	pendingQueries = ringbuffer.New[heartbeattypes.QueryPlanQuery](defaultMaxPendingQueriesSize)
+
+	// pendingTransactions is the ring buffer of completed transactions pending to send to the API
+	pendingTransactions = ringbuffer.New[heartbeattypes.QueryPlanTransaction](defaultMaxPendingTransactionsSize)
 )
 
+// SendPendingQueries uploads everything captured since the last send. the
+// buffers are emptied up front, so queries captured during the upload are kept
+// for the next one, and only the batches that didn't make it are put back
 func SendPendingQueries(ctx context.Context, opts daemontypes.DaemonOpts) error {
-	queries := pendingQueries.GetAll()
-	if len(queries) == 0 {
+	queries := pendingQueries.TakeAll()
+	transactions := pendingTransactions.TakeAll()
+
+	var aggregates []heartbeattypes.QueryPlanQueryAggregate
+	if queryAggregator != nil {
+		aggregates = queryAggregator.Flush()
+	}
+
+	if len(queries) == 0 && len(transactions) == 0 && len(aggregates) == 0 {
+		if querySpool != nil && querySpool.Len() > 0 {
+			return replaySpool(ctx, opts)
+		}
+
 		return nil
 	}
 
 	payload := heartbeattypes.QueryPlanQueriesPayload{
-		Queries: queries,
+		Queries:      queries,
+		Transactions: transactions,
 	}
 
-	marshaled, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("marshal payload: %v", err)
+	if len(aggregates) > 0 {
+		payload.Aggregates = aggregates
+		payload.DurationHistogramBounds = durationHistogramBounds
 	}
 
-	url := fmt.Sprintf("%s/v1/queries", opts.APIURL)
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(marshaled))
+	batches, err := splitPayload(payload, opts.MaxUploadBatchBytes)
 	if err != nil {
-		return fmt.Errorf("create request: %v", err)
+		requeueBatches([]heartbeattypes.QueryPlanQueriesPayload{payload})
+		return fmt.Errorf("split payload: %v", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.Token))
+	if querySpool != nil {
+		// anything already spooled goes first, so batches arrive in order
+		if err := replaySpool(ctx, opts); err != nil {
+			if spoolErr := spoolBatches(batches); spoolErr != nil {
+				requeueBatches(batches)
+				return fmt.Errorf("spool payload: %v (send: %v)", spoolErr, err)
+			}
 
-	if opts.Environment != "" {
-		req.Header.Set("X-QueryPlan-Environment", opts.Environment)
+			return fmt.Errorf("spooled payload: %v", err)
+		}
 	}
 
-	req.Header.Set("X-QueryPlan-DBMS", string(opts.DBMS))
-	req.Header.Set("X-QueryPlan-Database", opts.DatabaseName)
+	for i, batch := range batches {
+		marshaled, err := json.Marshal(batch)
+		if err != nil {
+			requeueBatches(batches[i:])
+			return fmt.Errorf("marshal payload: %v", err)
+		}
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("send request: %v", err)
+		err = sendQueriesPayload(ctx, opts, marshaled)
+		if err == nil {
+			continue
+		}
+
+		if apiclient.IsRejected(err) {
+			// sending it again won't change the answer
+			log.Printf("Dropping batch of %d queries and %d transactions rejected by the API: %v", len(batch.Queries), len(batch.Transactions), err)
+			metrics.QueriesDropped.WithLabelValues("rejected").Add(float64(len(batch.Queries)))
+			continue
+		}
+
+		if querySpool != nil {
+			if spoolErr := spoolBatches(batches[i:]); spoolErr != nil {
+				requeueBatches(batches[i:])
+				return fmt.Errorf("spool payload: %v (send: %v)", spoolErr, err)
+			}
+
+			return fmt.Errorf("spooled payload: %v", err)
+		}
+
+		requeueBatches(batches[i:])
+		return err
+	}
+
+	return nil
+}
+
+// requeueBatches puts the contents of batches that weren't sent back, to be
+// retried with the next send
+func requeueBatches(batches []heartbeattypes.QueryPlanQueriesPayload) {
+	var aggregates []heartbeattypes.QueryPlanQueryAggregate
+	for _, batch := range batches {
+		for _, query := range batch.Queries {
+			pendingQueries.Add(query)
+		}
+		for _, transaction := range batch.Transactions {
+			pendingTransactions.Add(transaction)
+		}
+		aggregates = append(aggregates, batch.Aggregates...)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if len(aggregates) > 0 {
+		queryAggregator.Restore(aggregates)
 	}
+}
+
+func sendQueriesPayload(ctx context.Context, opts daemontypes.DaemonOpts, marshaled []byte) error {
+	return apiclient.Default().Put(ctx, opts, "/v1/queries", marshaled)
+}
+
+func spoolBatches(batches []heartbeattypes.QueryPlanQueriesPayload) error {
+	for _, batch := range batches {
+		marshaled, err := json.Marshal(batch)
+		if err != nil {
+			return fmt.Errorf("marshal payload: %v", err)
+		}
 
-	pendingQueries.Clear()
+		if err := querySpool.Append(marshaled); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+// replaySpool sends the spooled batches. a batch the API rejects would block
+// the spool forever, so it's dropped instead
+func replaySpool(ctx context.Context, opts daemontypes.DaemonOpts) error {
+	return querySpool.Replay(func(batch []byte) error {
+		err := sendQueriesPayload(ctx, opts, batch)
+		if apiclient.IsRejected(err) {
+			log.Printf("Dropping spooled batch rejected by the API: %v", err)
+			return nil
+		}
+
+		return err
+	})
+}
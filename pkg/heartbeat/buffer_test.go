@@ -0,0 +1,79 @@
+package heartbeat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+)
+
+func pendingQueryTexts() []string {
+	texts := []string{}
+	for _, query := range pendingQueries.GetAll() {
+		texts = append(texts, query.Query)
+	}
+	return texts
+}
+
+func TestSendPendingQueries(t *testing.T) {
+	tests := []struct {
+		name string
+		// status is the API response, 0 to cancel the send instead
+		status      int
+		wantErr     bool
+		wantPending []string
+	}{
+		{
+			name:        "sent",
+			status:      http.StatusOK,
+			wantPending: []string{"select * from captured_during_send"},
+		},
+		{
+			name:        "rejected",
+			status:      http.StatusBadRequest,
+			wantPending: []string{"select * from captured_during_send"},
+		},
+		{
+			name:        "not sent",
+			wantErr:     true,
+			wantPending: []string{"select * from captured_during_send", "select * from users"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer pendingQueries.Clear()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sent := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pendingQueries.Add(types.QueryPlanQuery{Query: "select * from captured_during_send"})
+				if test.status == 0 {
+					// hold the response until the client gives up on it
+					cancel()
+					<-sent
+					return
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			pendingQueries.Add(types.QueryPlanQuery{Query: "select * from users"})
+
+			err := SendPendingQueries(ctx, daemontypes.DaemonOpts{APIURL: server.URL})
+			close(sent)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v; want error %v", err, test.wantErr)
+			}
+			if got := pendingQueryTexts(); !reflect.DeepEqual(got, test.wantPending) {
+				t.Errorf("got pending %q; want %q", got, test.wantPending)
+			}
+		})
+	}
+}
@@ -1,24 +1,143 @@
 package heartbeat
 
 import (
+	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
 )
 
-func CompleteCurrentQuery(currentQuery *types.CurrentQuery, rowCount int64) {
+const (
+	maxErrorMessageLength = 1024
+	maxTransactionQueries = 1000
+)
+
+// mysql single quotes identifiers as well as values ("Table 'db.t' doesn't
+// exist"), so only the quoted strings that follow the way messages introduce
+// a value are redacted, like "Duplicate entry '...'", "Incorrect integer
+// value: '...'" and postgres' "invalid input syntax for type integer: "...""
+var (
+	singleQuotedValueRegexp = regexp.MustCompile(`(\b(?:entry|value:?|for (?:type|enum) [\w ]+:) )'(?:[^'\\]|\\.|'')*'`)
+	doubleQuotedValueRegexp = regexp.MustCompile(`(\b(?:value:?|for (?:type|enum) [\w ]+:) )"(?:[^"\\]|\\.|"")*"`)
+	numericLiteralRegexp    = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// CompleteCurrentQuery records a query, and adds it to the transaction when
+// one is open on the connection
+func CompleteCurrentQuery(currentQuery *types.CurrentQuery, currentTransaction *types.CurrentTransaction, rowCount int64) {
 	if currentQuery == nil {
 		return
 	}
 
 	duration := time.Now().UnixNano() - currentQuery.ExecutionStartedAt
 
-	AddPendingQuery(*currentQuery, duration, rowCount)
+	AddPendingQuery(*currentQuery, currentTransaction, duration, rowCount)
 	currentQuery = nil
 }
 
-func AddPendingQuery(currentQuery types.CurrentQuery, duration int64, rowCount int64) {
+// FailCurrentQuery records a query that the database returned an error for
+func FailCurrentQuery(currentQuery *types.CurrentQuery, currentTransaction *types.CurrentTransaction, queryError types.QueryPlanQueryError) {
+	if currentQuery == nil {
+		return
+	}
+
+	duration := time.Now().UnixNano() - currentQuery.ExecutionStartedAt
+
+	AddFailedQuery(*currentQuery, currentTransaction, duration, queryError)
+}
+
+// StartTransaction returns a new transaction to collect queries in
+func StartTransaction(startedAt int64) *types.CurrentTransaction {
+	return &types.CurrentTransaction{
+		StartedAt: startedAt,
+		Queries:   []types.QueryPlanQuery{},
+	}
+}
+
+// CompleteTransaction records a transaction that was committed or rolled back
+func CompleteTransaction(currentTransaction *types.CurrentTransaction, outcome types.TransactionOutcome) {
+	if currentTransaction == nil {
+		return
+	}
+
+	qpt := types.QueryPlanTransaction{
+		StartedAt:  currentTransaction.StartedAt,
+		Duration:   time.Now().UnixNano() - currentTransaction.StartedAt,
+		Outcome:    outcome,
+		Queries:    currentTransaction.Queries,
+		QueryCount: currentTransaction.QueryCount,
+
+		QuerySummaries: currentTransaction.QuerySummaries,
+	}
+
+	pendingTransactions.Add(qpt)
+}
+
+func addQuery(qpq types.QueryPlanQuery) {
+	metrics.QueriesCaptured.Inc()
+
+	if queryAggregator != nil {
+		queryAggregator.Add(qpq)
+		return
+	}
+
+	// a full ring buffer overwrites the oldest query
+	if pendingQueries.Len() >= defaultMaxPendingQueriesSize {
+		metrics.QueriesDropped.WithLabelValues("ring_buffer_full").Inc()
+	}
+
+	pendingQueries.Add(qpq)
+}
+
+func addTransactionQuery(currentTransaction *types.CurrentTransaction, qpq types.QueryPlanQuery) {
+	if currentTransaction == nil {
+		return
+	}
+
+	currentTransaction.QueryCount++
+
+	if queryAggregator != nil {
+		// individual executions aren't uploaded when aggregating, so the
+		// transaction only keeps a summary of each query it ran
+		addTransactionQuerySummary(currentTransaction, qpq)
+		return
+	}
+
+	if len(currentTransaction.Queries) < maxTransactionQueries {
+		currentTransaction.Queries = append(currentTransaction.Queries, qpq)
+	}
+}
+
+func addTransactionQuerySummary(currentTransaction *types.CurrentTransaction, qpq types.QueryPlanQuery) {
+	if currentTransaction.QuerySummaryIndex == nil {
+		currentTransaction.QuerySummaryIndex = map[string]int{}
+	}
+
+	i, ok := currentTransaction.QuerySummaryIndex[qpq.Query]
+	if !ok {
+		if len(currentTransaction.QuerySummaries) >= maxTransactionQueries {
+			return
+		}
+		i = len(currentTransaction.QuerySummaries)
+		currentTransaction.QuerySummaries = append(currentTransaction.QuerySummaries, types.QueryPlanTransactionQuery{
+			Query: qpq.Query,
+		})
+		currentTransaction.QuerySummaryIndex[qpq.Query] = i
+	}
+
+	summary := &currentTransaction.QuerySummaries[i]
+	summary.Count++
+	if qpq.Error != nil {
+		summary.ErrorCount++
+	}
+	summary.TotalDuration += qpq.Duration
+	summary.TotalRowCount += qpq.RowCount
+}
+
+func AddPendingQuery(currentQuery types.CurrentQuery, currentTransaction *types.CurrentTransaction, duration int64, rowCount int64) {
 	// some queries we filter here
 	if isFilteredQuery(currentQuery.Query) {
 		return
@@ -32,7 +151,47 @@ func AddPendingQuery(currentQuery types.CurrentQuery, duration int64, rowCount i
 		IsPreparedStatement: currentQuery.IsPreparedStatement,
 	}
 
-	pendingQueries.Add(qpq)
+	addQuery(qpq)
+	addTransactionQuery(currentTransaction, qpq)
+}
+
+func AddFailedQuery(currentQuery types.CurrentQuery, currentTransaction *types.CurrentTransaction, duration int64, queryError types.QueryPlanQueryError) {
+	if isFilteredQuery(currentQuery.Query) {
+		return
+	}
+
+	queryError.Message = cleanErrorMessage(queryError.Message)
+
+	qpq := types.QueryPlanQuery{
+		Query:               currentQuery.Query,
+		ExecutedAt:          time.Now().UnixNano(),
+		Duration:            duration,
+		IsPreparedStatement: currentQuery.IsPreparedStatement,
+		Error:               &queryError,
+	}
+
+	addQuery(qpq)
+	addTransactionQuery(currentTransaction, qpq)
+}
+
+// cleanErrorMessage removes the literal values that error messages often
+// include, like the duplicate value in a unique key violation
+func cleanErrorMessage(message string) string {
+	message = strings.TrimSpace(message)
+	message = singleQuotedValueRegexp.ReplaceAllString(message, "$1'?'")
+	message = doubleQuotedValueRegexp.ReplaceAllString(message, `$1"?"`)
+	message = numericLiteralRegexp.ReplaceAllString(message, "?")
+
+	if len(message) > maxErrorMessageLength {
+		// don't split a multi byte character
+		n := maxErrorMessageLength
+		for n > 0 && !utf8.RuneStart(message[n]) {
+			n--
+		}
+		message = message[:n]
+	}
+
+	return message
 }
 
 func isFilteredQuery(query string) bool {
@@ -44,6 +203,10 @@ func isFilteredQuery(query string) bool {
 		return true
 	}
 
+	if strings.ToLower(query) == "begin" {
+		return true
+	}
+
 	if strings.ToLower(query) == "commit" {
 		return true
 	}
@@ -0,0 +1,77 @@
+package heartbeat
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanErrorMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{
+			name:    "mysql duplicate entry",
+			message: "Duplicate entry 'alice@example.com' for key 'users.email'",
+			want:    "Duplicate entry '?' for key 'users.email'",
+		},
+		{
+			name:    "mysql escaped quote in the value",
+			message: `Duplicate entry 'o\'brien' for key 'users.name'`,
+			want:    "Duplicate entry '?' for key 'users.name'",
+		},
+		{
+			name:    "mysql missing table",
+			message: "Table 'shop.orders' doesn't exist",
+			want:    "Table 'shop.orders' doesn't exist",
+		},
+		{
+			name:    "mysql unknown column",
+			message: "Unknown column 'nmae' in 'field list'",
+			want:    "Unknown column 'nmae' in 'field list'",
+		},
+		{
+			name:    "mysql incorrect value",
+			message: "Incorrect integer value: 'abc' for column 'age' at row 1",
+			want:    "Incorrect integer value: '?' for column 'age' at row ?",
+		},
+		{
+			name:    "postgres invalid input",
+			message: `invalid input syntax for type integer: "abc"`,
+			want:    `invalid input syntax for type integer: "?"`,
+		},
+		{
+			name:    "postgres unique violation",
+			message: `duplicate key value violates unique constraint "users_email_key"`,
+			want:    `duplicate key value violates unique constraint "users_email_key"`,
+		},
+		{
+			name:    "numbers",
+			message: "Lock wait timeout exceeded; try restarting transaction after 50.5 seconds",
+			want:    "Lock wait timeout exceeded; try restarting transaction after ? seconds",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cleanErrorMessage(test.message); got != test.want {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCleanErrorMessageTruncatesOnRuneBoundary(t *testing.T) {
+	// a 3 byte character straddles the limit
+	message := strings.Repeat("a", maxErrorMessageLength-1) + "€"
+
+	got := cleanErrorMessage(message)
+	if !utf8.ValidString(got) {
+		t.Errorf("got an invalid utf-8 message ending in %q", got[len(got)-3:])
+	}
+	if len(got) != maxErrorMessageLength-1 {
+		t.Errorf("got %d bytes; want %d", len(got), maxErrorMessageLength-1)
+	}
+}
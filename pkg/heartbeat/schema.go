@@ -0,0 +1,330 @@
+package heartbeat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/apiclient"
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+)
+
+const (
+	// an unchanged schema is still uploaded this often, to refresh stats that
+	// only drifted a little
+	maxSchemaUploadAge = 6 * time.Hour
+
+	// a table whose row count or sizes moved by more than this fraction since
+	// the last upload makes the schema be uploaded again
+	materialStatsChange = 0.1
+)
+
+var (
+	uploadedSchema = &schemaState{}
+)
+
+type schemaState struct {
+	mu         sync.Mutex
+	hash       string
+	payload    *types.QueryPlanTablesPayload
+	uploadedAt time.Time
+}
+
+// SendSchema uploads the schema when its structure or the table stats changed
+// since the last upload. a structure change also sends a schema change event
+// with the diff
+func SendSchema(ctx context.Context, opts daemontypes.DaemonOpts, payload types.QueryPlanTablesPayload) error {
+	hash, err := schemaHash(payload)
+	if err != nil {
+		return fmt.Errorf("hash schema: %v", err)
+	}
+
+	uploadedSchema.mu.Lock()
+	defer uploadedSchema.mu.Unlock()
+
+	if hash == uploadedSchema.hash && time.Since(uploadedSchema.uploadedAt) < maxSchemaUploadAge &&
+		!statsMovedMaterially(*uploadedSchema.payload, payload) {
+		return nil
+	}
+
+	marshaled, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %v", err)
+	}
+
+	if err := apiclient.Default().Put(ctx, opts, "/v1/schema", marshaled); err != nil {
+		return fmt.Errorf("put schema: %v", err)
+	}
+
+	// after a restart there is nothing to compare to
+	if uploadedSchema.payload != nil && hash != uploadedSchema.hash {
+		if err := sendSchemaChange(ctx, opts, *uploadedSchema.payload, payload, uploadedSchema.hash, hash); err != nil {
+			return err
+		}
+	}
+
+	uploadedSchema.hash = hash
+	uploadedSchema.payload = &payload
+	uploadedSchema.uploadedAt = time.Now()
+
+	return nil
+}
+
+// sendSchemaChange posts the diff between two schemas. a hash can change
+// without anything a change event describes changing, like the order of the
+// columns, and nothing is sent then
+func sendSchemaChange(ctx context.Context, opts daemontypes.DaemonOpts, previous types.QueryPlanTablesPayload, current types.QueryPlanTablesPayload, previousHash string, hash string) error {
+	event := diffSchema(previous, current)
+	if len(event.AddedTables) == 0 && len(event.DroppedTables) == 0 && len(event.ChangedTables) == 0 &&
+		len(event.AddedRelationships) == 0 && len(event.DroppedRelationships) == 0 {
+		return nil
+	}
+
+	event.DetectedAt = time.Now().UnixNano()
+	event.PreviousHash = previousHash
+	event.Hash = hash
+
+	log.Printf("Schema changed: %d tables added, %d dropped, %d changed", len(event.AddedTables), len(event.DroppedTables), len(event.ChangedTables))
+
+	marshaled, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal schema change: %v", err)
+	}
+
+	// the schema isn't recorded as uploaded, so a failure here is retried
+	// with the same diff
+	if err := apiclient.Default().Post(ctx, opts, "/v1/schema/changes", marshaled); err != nil {
+		return fmt.Errorf("post schema change: %v", err)
+	}
+
+	return nil
+}
+
+// schemaHash hashes the structure of the schema. stats like the row count
+// and sizes change all the time, so they are left out
+func schemaHash(payload types.QueryPlanTablesPayload) (string, error) {
+	tables := make([]types.Table, len(payload.Tables))
+	copy(tables, payload.Tables)
+
+	for i := range tables {
+		tables[i].EstimatedRowCount = 0
+		tables[i].DataSizeBytes = 0
+		tables[i].IndexSizeBytes = 0
+	}
+
+	sort.Slice(tables, func(i, j int) bool {
+		return qualifiedTableName(tables[i]) < qualifiedTableName(tables[j])
+	})
+
+	normalized := payload
+	normalized.Tables = tables
+
+	marshaled, err := json.Marshal(normalized)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(marshaled)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// statsMovedMaterially returns true when a table's row count or sizes moved by
+// more than materialStatsChange. it is compared to the last upload rather than
+// the last collection, so slow growth is still uploaded once it adds up
+func statsMovedMaterially(previous types.QueryPlanTablesPayload, current types.QueryPlanTablesPayload) bool {
+	previousTables := map[string]types.Table{}
+	for _, table := range previous.Tables {
+		previousTables[qualifiedTableName(table)] = table
+	}
+
+	for _, table := range current.Tables {
+		previousTable, ok := previousTables[qualifiedTableName(table)]
+		if !ok {
+			return true
+		}
+
+		if movedMaterially(previousTable.EstimatedRowCount, table.EstimatedRowCount) ||
+			movedMaterially(previousTable.DataSizeBytes, table.DataSizeBytes) ||
+			movedMaterially(previousTable.IndexSizeBytes, table.IndexSizeBytes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func movedMaterially(previous int64, current int64) bool {
+	diff := current - previous
+	if diff < 0 {
+		diff = -diff
+	}
+
+	// anything moves materially from 0
+	return float64(diff) > materialStatsChange*float64(previous)
+}
+
+// qualifiedTableName is schema.table for postgres, and just the table for mysql
+func qualifiedTableName(table types.Table) string {
+	if table.SchemaName == "" {
+		return table.TableName
+	}
+	return table.SchemaName + "." + table.TableName
+}
+
+func diffSchema(previous types.QueryPlanTablesPayload, current types.QueryPlanTablesPayload) types.QueryPlanSchemaChangeEvent {
+	event := types.QueryPlanSchemaChangeEvent{
+		AddedTables:   []string{},
+		DroppedTables: []string{},
+		ChangedTables: []types.TableChange{},
+	}
+
+	previousTables := map[string]types.Table{}
+	for _, table := range previous.Tables {
+		previousTables[qualifiedTableName(table)] = table
+	}
+
+	currentTables := map[string]bool{}
+	for _, table := range current.Tables {
+		currentTables[qualifiedTableName(table)] = true
+
+		previousTable, ok := previousTables[qualifiedTableName(table)]
+		if !ok {
+			event.AddedTables = append(event.AddedTables, qualifiedTableName(table))
+			continue
+		}
+
+		if change, changed := diffTable(previousTable, table); changed {
+			event.ChangedTables = append(event.ChangedTables, change)
+		}
+	}
+
+	for _, table := range previous.Tables {
+		if !currentTables[qualifiedTableName(table)] {
+			event.DroppedTables = append(event.DroppedTables, qualifiedTableName(table))
+		}
+	}
+
+	event.AddedRelationships = missingRelationships(current.Relationships, previous.Relationships)
+	event.DroppedRelationships = missingRelationships(previous.Relationships, current.Relationships)
+
+	sort.Strings(event.AddedTables)
+	sort.Strings(event.DroppedTables)
+	sort.Slice(event.ChangedTables, func(i, j int) bool {
+		if event.ChangedTables[i].SchemaName != event.ChangedTables[j].SchemaName {
+			return event.ChangedTables[i].SchemaName < event.ChangedTables[j].SchemaName
+		}
+		return event.ChangedTables[i].TableName < event.ChangedTables[j].TableName
+	})
+
+	return event
+}
+
+// missingRelationships returns the relationships that aren't in other
+func missingRelationships(relationships []types.Relationship, other []types.Relationship) []types.Relationship {
+	var missing []types.Relationship
+	for _, relationship := range relationships {
+		found := false
+		for _, o := range other {
+			if reflect.DeepEqual(relationship, o) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, relationship)
+		}
+	}
+
+	return missing
+}
+
+func diffTable(previous types.Table, current types.Table) (types.TableChange, bool) {
+	change := types.TableChange{
+		SchemaName: current.SchemaName,
+		TableName:  current.TableName,
+	}
+	changed := false
+
+	previousColumns := map[string]types.Column{}
+	for _, column := range previous.Columns {
+		previousColumns[column.ColumnName] = column
+	}
+
+	currentColumns := map[string]bool{}
+	for _, column := range current.Columns {
+		currentColumns[column.ColumnName] = true
+
+		previousColumn, ok := previousColumns[column.ColumnName]
+		if !ok {
+			change.AddedColumns = append(change.AddedColumns, column)
+			changed = true
+			continue
+		}
+
+		if !reflect.DeepEqual(previousColumn, column) {
+			change.ChangedColumns = append(change.ChangedColumns, types.ColumnChange{
+				ColumnName: column.ColumnName,
+				Previous:   previousColumn,
+				Current:    column,
+			})
+			changed = true
+		}
+	}
+
+	for _, column := range previous.Columns {
+		if !currentColumns[column.ColumnName] {
+			change.DroppedColumns = append(change.DroppedColumns, column.ColumnName)
+			changed = true
+		}
+	}
+
+	previousIndexes := map[string]types.Index{}
+	for _, index := range previous.Indexes {
+		previousIndexes[index.IndexName] = index
+	}
+
+	currentIndexes := map[string]bool{}
+	for _, index := range current.Indexes {
+		currentIndexes[index.IndexName] = true
+
+		previousIndex, ok := previousIndexes[index.IndexName]
+		if !ok {
+			change.AddedIndexes = append(change.AddedIndexes, index)
+			changed = true
+			continue
+		}
+
+		if !reflect.DeepEqual(previousIndex, index) {
+			change.ChangedIndexes = append(change.ChangedIndexes, types.IndexChange{
+				IndexName: index.IndexName,
+				Previous:  previousIndex,
+				Current:   index,
+			})
+			changed = true
+		}
+	}
+
+	for _, index := range previous.Indexes {
+		if !currentIndexes[index.IndexName] {
+			change.DroppedIndexes = append(change.DroppedIndexes, index.IndexName)
+			changed = true
+		}
+	}
+
+	if !reflect.DeepEqual(previous.PrimaryKeys, current.PrimaryKeys) {
+		change.PreviousPrimaryKeys = previous.PrimaryKeys
+		change.PrimaryKeys = current.PrimaryKeys
+		changed = true
+	}
+
+	return change, changed
+}
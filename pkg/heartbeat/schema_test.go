@@ -0,0 +1,137 @@
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+)
+
+func TestSendSchema(t *testing.T) {
+	defer func() { uploadedSchema = &schemaState{} }()
+
+	requests := []string{}
+	var event types.QueryPlanSchemaChangeEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/v1/schema/changes" {
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &event); err != nil {
+				t.Error(err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	opts := daemontypes.DaemonOpts{APIURL: server.URL}
+	payload := func(rowCount int64, columns ...types.Column) types.QueryPlanTablesPayload {
+		return types.QueryPlanTablesPayload{
+			Tables: []types.Table{
+				{TableName: "users", Columns: columns, PrimaryKeys: []string{"id"}, EstimatedRowCount: rowCount, DataSizeBytes: rowCount * 100},
+				{TableName: "sessions", Columns: []types.Column{{ColumnName: "id", DataType: "int"}}, PrimaryKeys: []string{"id"}},
+			},
+		}
+	}
+
+	id := types.Column{ColumnName: "id", DataType: "int"}
+	email := types.Column{ColumnName: "email", DataType: "varchar", ColumnType: "varchar(255)"}
+
+	for _, p := range []types.QueryPlanTablesPayload{
+		payload(10, id, email),
+		payload(10, id, email),
+		// the stats only drifted
+		payload(11, id, email),
+	} {
+		if err := SendSchema(context.Background(), opts, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"PUT /v1/schema"}; !reflect.DeepEqual(requests, want) {
+		t.Fatalf("got requests %v; want %v", requests, want)
+	}
+
+	// the stats moved materially, which is uploaded without a change event
+	if err := SendSchema(context.Background(), opts, payload(20, id, email)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"PUT /v1/schema", "PUT /v1/schema"}; !reflect.DeepEqual(requests, want) {
+		t.Fatalf("got requests %v; want %v", requests, want)
+	}
+
+	widerEmail := email
+	widerEmail.ColumnType = "varchar(512)"
+	name := types.Column{ColumnName: "name", DataType: "text"}
+
+	changed := payload(20, id, widerEmail, name)
+	changed.Tables = changed.Tables[:1]
+	if err := SendSchema(context.Background(), opts, changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"PUT /v1/schema", "PUT /v1/schema", "PUT /v1/schema", "POST /v1/schema/changes"}; !reflect.DeepEqual(requests, want) {
+		t.Fatalf("got requests %v; want %v", requests, want)
+	}
+
+	want := []types.TableChange{{
+		TableName:      "users",
+		AddedColumns:   []types.Column{name},
+		ChangedColumns: []types.ColumnChange{{ColumnName: "email", Previous: email, Current: widerEmail}},
+	}}
+	if !reflect.DeepEqual(event.ChangedTables, want) {
+		t.Errorf("got changed tables %+v; want %+v", event.ChangedTables, want)
+	}
+	if !reflect.DeepEqual(event.DroppedTables, []string{"sessions"}) {
+		t.Errorf("got dropped tables %v; want [sessions]", event.DroppedTables)
+	}
+	if event.PreviousHash == "" || event.PreviousHash == event.Hash {
+		t.Errorf("got hashes %q and %q; want two different hashes", event.PreviousHash, event.Hash)
+	}
+
+	// the same columns in a different order change the hash, but not the diff
+	reordered := payload(20, name, widerEmail, id)
+	reordered.Tables = reordered.Tables[:1]
+	requests = []string{}
+	if err := SendSchema(context.Background(), opts, reordered); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"PUT /v1/schema"}; !reflect.DeepEqual(requests, want) {
+		t.Fatalf("got requests %v; want %v", requests, want)
+	}
+}
+
+func TestDiffSchemaRelationships(t *testing.T) {
+	userID := types.Relationship{
+		ConstraintName:       "sessions_user_id_fkey",
+		SchemaName:           "public",
+		TableName:            "sessions",
+		Columns:              []string{"user_id"},
+		ReferencedSchemaName: "public",
+		ReferencedTableName:  "users",
+		ReferencedColumns:    []string{"id"},
+		OnUpdate:             "NO ACTION",
+		OnDelete:             "NO ACTION",
+	}
+	cascade := userID
+	cascade.OnDelete = "CASCADE"
+
+	event := diffSchema(
+		types.QueryPlanTablesPayload{Relationships: []types.Relationship{userID}},
+		types.QueryPlanTablesPayload{Relationships: []types.Relationship{cascade}},
+	)
+
+	if !reflect.DeepEqual(event.AddedRelationships, []types.Relationship{cascade}) {
+		t.Errorf("got added relationships %+v; want %+v", event.AddedRelationships, cascade)
+	}
+	if !reflect.DeepEqual(event.DroppedRelationships, []types.Relationship{userID}) {
+		t.Errorf("got dropped relationships %+v; want %+v", event.DroppedRelationships, userID)
+	}
+}
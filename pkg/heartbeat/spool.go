@@ -0,0 +1,208 @@
+package heartbeat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentExtension = ".jsonl"
+)
+
+var (
+	// querySpool is nil unless a spool directory is configured, in which case
+	// batches that can't be uploaded are written to disk instead of being
+	// kept in (and overwritten in) the ring buffers
+	querySpool *spool
+)
+
+// spool is a directory of append only segment files. each line in a segment
+// is one marshaled QueryPlanQueriesPayload, and segments are replayed oldest
+// first. delivery is at least once, a batch can be sent again if the process
+// restarts part way through a segment
+type spool struct {
+	mu           sync.Mutex
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	segments []*spoolSegment
+	nextSeq  uint64
+
+	// replayed is the number of batches at the start of the oldest segment
+	// that have already been sent
+	replayed int
+}
+
+type spoolSegment struct {
+	path string
+	seq  uint64
+	size int64
+}
+
+// EnableSpool opens (or creates) the spool directory. batches that are already
+// there from a previous run are replayed on the next send
+func EnableSpool(dir string, maxBytes int64, segmentBytes int64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create spool dir: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read spool dir: %v", err)
+	}
+
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		segments:     []*spoolSegment{},
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolSegmentExtension) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolSegmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("stat spool segment: %v", err)
+		}
+
+		s.segments = append(s.segments, &spoolSegment{
+			path: filepath.Join(dir, entry.Name()),
+			seq:  seq,
+			size: info.Size(),
+		})
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	if len(s.segments) > 0 {
+		s.nextSeq = s.segments[len(s.segments)-1].seq + 1
+		log.Printf("Found %d spooled segments in %s", len(s.segments), dir)
+	}
+
+	querySpool = s
+	return nil
+}
+
+// Len returns the number of segments waiting to be replayed
+func (s *spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.segments)
+}
+
+// Append writes a batch to the newest segment, rotating to a new segment when
+// it is full, and drops the oldest segments when over the size limit
+func (s *spool) Append(batch []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size >= s.segmentBytes {
+		s.segments = append(s.segments, &spoolSegment{
+			path: filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.nextSeq, spoolSegmentExtension)),
+			seq:  s.nextSeq,
+		})
+		s.nextSeq++
+	}
+
+	segment := s.segments[len(s.segments)-1]
+
+	f, err := os.OpenFile(segment.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open segment: %v", err)
+	}
+	defer f.Close()
+
+	n, err := f.Write(append(batch, '\n'))
+	segment.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write segment: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync segment: %v", err)
+	}
+
+	s.enforceLimit()
+	return nil
+}
+
+// Replay sends every spooled batch in order, removing each segment once all
+// of its batches are sent. it stops at the first batch that fails to send
+func (s *spool) Replay(send func(batch []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.segments) > 0 {
+		segment := s.segments[0]
+
+		data, err := os.ReadFile(segment.path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("read segment: %v", err)
+		}
+
+		batches := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+		for i := s.replayed; i < len(batches); i++ {
+			// a partial line is left behind if the process died mid write
+			if len(batches[i]) > 0 && json.Valid(batches[i]) {
+				if err := send(batches[i]); err != nil {
+					return err
+				}
+			} else if len(batches[i]) > 0 {
+				log.Printf("Skipping corrupt batch %d in spool segment %s", i, segment.path)
+			}
+
+			s.replayed++
+		}
+
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove segment: %v", err)
+		}
+
+		s.segments = s.segments[1:]
+		s.replayed = 0
+	}
+
+	return nil
+}
+
+// enforceLimit removes the oldest segments until the spool is under maxBytes.
+// the newest segment is always kept. the caller must hold the lock
+func (s *spool) enforceLimit() {
+	total := int64(0)
+	for _, segment := range s.segments {
+		total += segment.size
+	}
+
+	for total > s.maxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing spool segment %s: %v", oldest.path, err)
+			return
+		}
+
+		log.Printf("Spool is over %d bytes, dropped segment %s", s.maxBytes, oldest.path)
+		total -= oldest.size
+		s.segments = s.segments[1:]
+		s.replayed = 0
+	}
+}
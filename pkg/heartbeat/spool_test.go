@@ -0,0 +1,90 @@
+package heartbeat
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	defer func() { querySpool = nil }()
+
+	dir := t.TempDir()
+	if err := EnableSpool(dir, 1<<20, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := querySpool.Append([]byte(fmt.Sprintf(`{"batch":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each segment holds two batches before it's over 20 bytes
+	if querySpool.Len() != 3 {
+		t.Fatalf("got %d segments; want 3", querySpool.Len())
+	}
+
+	sent := []string{}
+	errUnavailable := errors.New("unavailable")
+	err := querySpool.Replay(func(batch []byte) error {
+		if len(sent) == 3 {
+			return errUnavailable
+		}
+		sent = append(sent, string(batch))
+		return nil
+	})
+	if err != errUnavailable {
+		t.Fatalf("got error %v; want %v", err, errUnavailable)
+	}
+
+	// reopen, as if the process restarted, to check segments are read back in order
+	if err := EnableSpool(dir, 1<<20, 20); err != nil {
+		t.Fatal(err)
+	}
+	if querySpool.Len() != 2 {
+		t.Fatalf("got %d segments after reopen; want 2", querySpool.Len())
+	}
+
+	if err := querySpool.Replay(func(batch []byte) error {
+		sent = append(sent, string(batch))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restart loses the position in the segment, so batch 2 is sent twice
+	want := []string{`{"batch":0}`, `{"batch":1}`, `{"batch":2}`, `{"batch":2}`, `{"batch":3}`, `{"batch":4}`}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("got %v; want %v", sent, want)
+	}
+	if querySpool.Len() != 0 {
+		t.Errorf("got %d segments after replay; want 0", querySpool.Len())
+	}
+
+	t.Run("Limit", func(t *testing.T) {
+		if err := EnableSpool(t.TempDir(), 30, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 5; i++ {
+			if err := querySpool.Append([]byte(fmt.Sprintf(`{"batch":%d}`, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sent := []string{}
+		if err := querySpool.Replay(func(batch []byte) error {
+			sent = append(sent, string(batch))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{`{"batch":3}`, `{"batch":4}`}
+		if !reflect.DeepEqual(sent, want) {
+			t.Errorf("got %v; want %v", sent, want)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package types
+
+// QueryPlanQueryAggregate summarizes every execution of a cleaned query
+// during a flush window
+type QueryPlanQueryAggregate struct {
+	Query       string `json:"query"`
+	WindowStart int64  `json:"window_start"`
+	WindowEnd   int64  `json:"window_end"`
+
+	Count                  int64 `json:"count"`
+	ErrorCount             int64 `json:"error_count"`
+	PreparedStatementCount int64 `json:"prepared_statement_count"`
+
+	// Errors breaks ErrorCount down by the error that was returned
+	Errors []QueryPlanQueryErrorCount `json:"errors,omitempty"`
+
+	TotalDuration int64 `json:"total_duration"`
+	MinDuration   int64 `json:"min_duration"`
+	MaxDuration   int64 `json:"max_duration"`
+	P50Duration   int64 `json:"p50_duration"`
+	P95Duration   int64 `json:"p95_duration"`
+	P99Duration   int64 `json:"p99_duration"`
+
+	// DurationHistogram has a count for each bucket in DurationHistogramBounds,
+	// plus a final bucket for everything above the last bound
+	DurationHistogram []int64 `json:"duration_histogram"`
+
+	TotalRowCount int64 `json:"total_row_count"`
+	MinRowCount   int64 `json:"min_row_count"`
+	MaxRowCount   int64 `json:"max_row_count"`
+}
+
+// QueryPlanQueryErrorCount counts the executions of a query that failed with
+// the same SQLSTATE and error code
+type QueryPlanQueryErrorCount struct {
+	SQLState  string `json:"sql_state"`
+	ErrorCode int    `json:"error_code,omitempty"`
+	Count     int64  `json:"count"`
+}
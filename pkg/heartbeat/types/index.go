@@ -0,0 +1,15 @@
+package types
+
+type Index struct {
+	IndexName string `json:"index_name"`
+	// Columns are in index order. expression indexes have the expression instead
+	// of a column name
+	Columns   []string `json:"columns"`
+	IsUnique  bool     `json:"is_unique"`
+	IsPrimary bool     `json:"is_primary"`
+	// IndexType is the access method, like BTREE or FULLTEXT in mysql and
+	// btree or gin in postgres
+	IndexType string `json:"index_type"`
+	// Predicate is the where clause of a postgres partial index
+	Predicate *string `json:"predicate,omitempty"`
+}
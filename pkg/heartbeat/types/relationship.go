@@ -0,0 +1,25 @@
+package types
+
+// UniqueConstraint is a unique constraint, the columns are in constraint order
+type UniqueConstraint struct {
+	ConstraintName string   `json:"constraint_name"`
+	Columns        []string `json:"columns"`
+}
+
+// Relationship is a foreign key. Columns and ReferencedColumns are in
+// constraint order, so they pair up by position
+type Relationship struct {
+	ConstraintName string `json:"constraint_name"`
+
+	SchemaName string   `json:"schema_name,omitempty"`
+	TableName  string   `json:"table_name"`
+	Columns    []string `json:"columns"`
+
+	ReferencedSchemaName string   `json:"referenced_schema_name,omitempty"`
+	ReferencedTableName  string   `json:"referenced_table_name"`
+	ReferencedColumns    []string `json:"referenced_columns"`
+
+	// OnUpdate and OnDelete are the referential actions, like CASCADE or NO ACTION
+	OnUpdate string `json:"on_update"`
+	OnDelete string `json:"on_delete"`
+}
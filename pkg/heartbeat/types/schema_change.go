@@ -0,0 +1,49 @@
+package types
+
+// QueryPlanSchemaChangeEvent describes how the schema changed since the
+// previous upload, so query regressions can be linked to migrations
+type QueryPlanSchemaChangeEvent struct {
+	DetectedAt   int64  `json:"detected_at"`
+	PreviousHash string `json:"previous_hash"`
+	Hash         string `json:"hash"`
+
+	// AddedTables and DroppedTables are schema qualified for postgres
+	AddedTables   []string      `json:"added_tables"`
+	DroppedTables []string      `json:"dropped_tables"`
+	ChangedTables []TableChange `json:"changed_tables"`
+
+	// a foreign key that changed is dropped and added again
+	AddedRelationships   []Relationship `json:"added_relationships,omitempty"`
+	DroppedRelationships []Relationship `json:"dropped_relationships,omitempty"`
+}
+
+type TableChange struct {
+	SchemaName string `json:"schema_name,omitempty"`
+	TableName  string `json:"table_name"`
+
+	AddedColumns   []Column       `json:"added_columns,omitempty"`
+	DroppedColumns []string       `json:"dropped_columns,omitempty"`
+	ChangedColumns []ColumnChange `json:"changed_columns,omitempty"`
+
+	AddedIndexes   []Index       `json:"added_indexes,omitempty"`
+	DroppedIndexes []string      `json:"dropped_indexes,omitempty"`
+	ChangedIndexes []IndexChange `json:"changed_indexes,omitempty"`
+
+	// PreviousPrimaryKeys and PrimaryKeys are only set when the primary key changed
+	PreviousPrimaryKeys []string `json:"previous_primary_keys,omitempty"`
+	PrimaryKeys         []string `json:"primary_keys,omitempty"`
+}
+
+// IndexChange is an index that was redefined with the same name
+type IndexChange struct {
+	IndexName string `json:"index_name"`
+	Previous  Index  `json:"previous"`
+	Current   Index  `json:"current"`
+}
+
+// ColumnChange is a column whose type, nullability, default or key changed
+type ColumnChange struct {
+	ColumnName string `json:"column_name"`
+	Previous   Column `json:"previous"`
+	Current    Column `json:"current"`
+}
@@ -1,8 +1,16 @@
 package types
 
 type Table struct {
-	TableName         string   `json:"table_name"`
-	Columns           []Column `json:"columns"`
-	PrimaryKeys       []string `json:"primary_keys"`
-	EstimatedRowCount int64    `json:"estimated_row_count"`
+	// SchemaName is only set for postgres, mysql tables are all in the database
+	SchemaName        string             `json:"schema_name,omitempty"`
+	TableName         string             `json:"table_name"`
+	Columns           []Column           `json:"columns"`
+	PrimaryKeys       []string           `json:"primary_keys"`
+	Indexes           []Index            `json:"indexes"`
+	UniqueConstraints []UniqueConstraint `json:"unique_constraints,omitempty"`
+
+	// the stats are estimates, from the database's own statistics
+	EstimatedRowCount int64 `json:"estimated_row_count"`
+	DataSizeBytes     int64 `json:"data_size_bytes"`
+	IndexSizeBytes    int64 `json:"index_size_bytes"`
 }
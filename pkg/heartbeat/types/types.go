@@ -2,6 +2,8 @@ package types
 
 type QueryPlanTablesPayload struct {
 	Tables []Table `json:"tables"`
+	// Relationships are the foreign keys between the tables
+	Relationships []Relationship `json:"relationships,omitempty"`
 }
 
 type QueryPlanTablesResponse struct {
@@ -9,16 +11,59 @@ type QueryPlanTablesResponse struct {
 }
 
 type QueryPlanQuery struct {
-	ExecutedAt          int64  `json:"executed_at"`
-	Duration            int64  `json:"duration"`
-	RowCount            int64  `json:"row_count"`
-	Query               string `json:"query"`
-	IsPreparedStatement bool   `json:"is_prepared_statement"`
+	ExecutedAt          int64                `json:"executed_at"`
+	Duration            int64                `json:"duration"`
+	RowCount            int64                `json:"row_count"`
+	Query               string               `json:"query"`
+	IsPreparedStatement bool                 `json:"is_prepared_statement"`
+	Error               *QueryPlanQueryError `json:"error,omitempty"`
+}
+
+// QueryPlanQueryError is set on queries that the database rejected
+type QueryPlanQueryError struct {
+	// ErrorCode is the mysql error number, postgres only has the sql state
+	ErrorCode int    `json:"error_code,omitempty"`
+	SQLState  string `json:"sql_state"`
+	Message   string `json:"message"`
+}
+
+type TransactionOutcome string
+
+const (
+	TransactionOutcomeCommit   TransactionOutcome = "commit"
+	TransactionOutcomeRollback TransactionOutcome = "rollback"
+)
+
+type QueryPlanTransaction struct {
+	StartedAt int64              `json:"started_at"`
+	Duration  int64              `json:"duration"`
+	Outcome   TransactionOutcome `json:"outcome"`
+	// Queries are in execution order, and capped for very long transactions.
+	// QueryCount is always the total
+	Queries    []QueryPlanQuery `json:"queries"`
+	QueryCount int64            `json:"query_count"`
+
+	// QuerySummaries replace Queries when the proxy aggregates locally
+	QuerySummaries []QueryPlanTransactionQuery `json:"query_summaries,omitempty"`
+}
+
+// QueryPlanTransactionQuery summarizes the executions of a cleaned query
+// within a single transaction
+type QueryPlanTransactionQuery struct {
+	Query         string `json:"query"`
+	Count         int64  `json:"count"`
+	ErrorCount    int64  `json:"error_count"`
+	TotalDuration int64  `json:"total_duration"`
+	TotalRowCount int64  `json:"total_row_count"`
 }
 
 type QueryPlanQueriesPayload struct {
-	Queries []QueryPlanQuery `json:"queries"`
-	// Transactions []QueryPlanTransaction `json:"transactions"`
+	Queries      []QueryPlanQuery       `json:"queries"`
+	Transactions []QueryPlanTransaction `json:"transactions"`
+
+	// Aggregates replace Queries when the proxy aggregates locally
+	Aggregates              []QueryPlanQueryAggregate `json:"aggregates,omitempty"`
+	DurationHistogramBounds []int64                   `json:"duration_histogram_bounds,omitempty"`
 }
 
 type CurrentQuery struct {
@@ -26,3 +71,14 @@ type CurrentQuery struct {
 	Query               string
 	IsPreparedStatement bool
 }
+
+type CurrentTransaction struct {
+	StartedAt  int64
+	Queries    []QueryPlanQuery
+	QueryCount int64
+
+	// QuerySummaries are in the order each query was first seen, and
+	// QuerySummaryIndex maps a query to its summary
+	QuerySummaries    []QueryPlanTransactionQuery
+	QuerySummaryIndex map[string]int
+}
@@ -0,0 +1,226 @@
+package live
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
+)
+
+const (
+	// schema collection runs one query at a time, so the pool stays small to
+	// keep the load on the customer's database down
+	maxOpenConns    = 2
+	maxIdleConns    = 1
+	connMaxIdleTime = 5 * time.Minute
+	connMaxLifetime = 30 * time.Minute
+
+	pingTimeout = 10 * time.Second
+
+	DefaultHealthCheckInterval = time.Minute
+)
+
+type Options struct {
+	// DriverName is the database/sql driver, mysql or pgx
+	DriverName string
+	// URI is used when URIFile isn't set
+	URI string
+	// URIFile is read again on every health check, so rotated credentials,
+	// like a mounted secret, are picked up without a restart
+	URIFile string
+
+	HealthCheckInterval time.Duration
+}
+
+// Conn is the daemon's connection pool to the live database. it is shared by
+// everything that queries the database, and must be closed on shutdown
+type Conn struct {
+	opts Options
+
+	mu      sync.RWMutex
+	db      *sql.DB
+	uri     string
+	healthy bool
+	checked bool
+	closed  bool
+}
+
+// Open creates the pool. it doesn't connect, so an unreachable database
+// doesn't stop the proxy from starting
+func Open(opts Options) (*Conn, error) {
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+
+	c := &Conn{
+		opts: opts,
+	}
+
+	uri, err := c.readURI()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := c.open(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	c.db = db
+	c.uri = uri
+
+	return c, nil
+}
+
+// DB returns the current pool. callers shouldn't keep it, because it's
+// replaced when the credentials change
+func (c *Conn) DB() (*sql.DB, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return nil, fmt.Errorf("live connection is closed")
+	}
+
+	return c.db, nil
+}
+
+// Run checks the connection every health check interval until the context
+// is cancelled, picking up new credentials when the uri changes
+func (c *Conn) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		c.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the pool, waiting for running queries to finish
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	return c.db.Close()
+}
+
+func (c *Conn) check(ctx context.Context) {
+	if err := c.refresh(ctx); err != nil {
+		log.Printf("Error refreshing live connection: %v", err)
+	}
+
+	db, err := c.DB()
+	if err != nil {
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	err = db.PingContext(pingCtx)
+
+	c.mu.Lock()
+	wasHealthy, checked := c.healthy, c.checked
+	c.healthy, c.checked = err == nil, true
+	c.mu.Unlock()
+
+	if err == nil {
+		metrics.LiveConnectionHealthy.Set(1)
+	} else {
+		metrics.LiveConnectionHealthy.Set(0)
+	}
+
+	// only changes are logged, so an unreachable database doesn't log every interval
+	if err != nil && (wasHealthy || !checked) && ctx.Err() == nil {
+		log.Printf("Live connection health check failed: %v", err)
+	} else if err == nil && !wasHealthy && checked {
+		log.Printf("Live connection recovered")
+	}
+}
+
+// refresh replaces the pool when the uri changed. the new pool has to connect
+// before it's used, so a bad rotation keeps the old credentials working
+func (c *Conn) refresh(ctx context.Context) error {
+	uri, err := c.readURI()
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	unchanged := uri == c.uri || c.closed
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	db, err := c.open(uri)
+	if err != nil {
+		return err
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	if err := db.PingContext(pingCtx); err != nil {
+		db.Close()
+		return fmt.Errorf("connect with new credentials: %v", err)
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return db.Close()
+	}
+	previous := c.db
+	c.db = db
+	c.uri = uri
+	c.mu.Unlock()
+
+	log.Printf("Live connection credentials changed, replaced the connection pool")
+
+	return previous.Close()
+}
+
+func (c *Conn) readURI() (string, error) {
+	if c.opts.URIFile == "" {
+		return c.opts.URI, nil
+	}
+
+	b, err := os.ReadFile(c.opts.URIFile)
+	if err != nil {
+		return "", fmt.Errorf("read live connection uri file: %v", err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (c *Conn) open(uri string) (*sql.DB, error) {
+	db, err := sql.Open(c.opts.DriverName, uri)
+	if err != nil {
+		return nil, fmt.Errorf("open %s connection: %v", c.opts.DriverName, err)
+	}
+
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxIdleTime(connMaxIdleTime)
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	return db, nil
+}
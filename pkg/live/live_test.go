@@ -0,0 +1,76 @@
+package live
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeDriver connects to any uri except "down"
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	if name == "down" {
+		return nil, errors.New("connection refused")
+	}
+	return fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+func TestRefresh(t *testing.T) {
+	uriFile := filepath.Join(t.TempDir(), "uri")
+	writeURI := func(uri string) {
+		if err := os.WriteFile(uriFile, []byte(uri+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeURI("first")
+	c, err := Open(Options{DriverName: "fake", URIFile: uriFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.check(context.Background())
+	if !c.healthy || c.uri != "first" {
+		t.Fatalf("got healthy %v with uri %q; want healthy with the first uri", c.healthy, c.uri)
+	}
+
+	first, _ := c.DB()
+
+	// credentials that don't work keep the pool that does
+	writeURI("down")
+	c.check(context.Background())
+	if db, _ := c.DB(); db != first || !c.healthy {
+		t.Fatalf("pool was replaced by one that can't connect")
+	}
+
+	writeURI("second")
+	c.check(context.Background())
+	if db, _ := c.DB(); db == first || c.uri != "second" {
+		t.Fatalf("got uri %q; want the pool replaced with the second uri", c.uri)
+	}
+	if err := first.Ping(); err == nil {
+		t.Errorf("previous pool is still open")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DB(); err == nil {
+		t.Errorf("got a pool after close; want an error")
+	}
+}
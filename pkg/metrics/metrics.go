@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "queryplan_proxy"
+
+	DirectionClientToUpstream = "client_to_upstream"
+	DirectionUpstreamToClient = "upstream_to_client"
+)
+
+var (
+	ActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Client connections that are currently open.",
+	}, []string{"dbms"})
+
+	Connections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "Client connections accepted.",
+	}, []string{"dbms"})
+
+	BytesProxied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_proxied_total",
+		Help:      "Bytes copied between clients and the upstream database.",
+	}, []string{"dbms", "direction"})
+
+	QueriesCaptured = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_captured_total",
+		Help:      "Queries recorded for upload.",
+	})
+
+	QueriesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_dropped_total",
+		Help:      "Queries that were recorded but will never be uploaded.",
+	}, []string{"reason"})
+
+	ParseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_errors_total",
+		Help:      "Protocol messages the proxy could not parse.",
+	}, []string{"dbms", "kind"})
+
+	UploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Time taken by uploads to the QueryPlan API, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"path"})
+
+	UploadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_failures_total",
+		Help:      "Uploads to the QueryPlan API that failed after all retries.",
+	}, []string{"path"})
+
+	SchemaCollectionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "schema_collection_duration_seconds",
+		Help:      "Time taken to read the schema from the live database.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"dbms"})
+
+	LiveConnectionHealthy = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "live_connection_healthy",
+		Help:      "1 when the last health check of the schema collection connection reached the database, 0 when it didn't.",
+	})
+)
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// CountReads returns conn with the bytes read from it added to counter
+func CountReads(conn net.Conn, counter prometheus.Counter) net.Conn {
+	return &countingConn{
+		Conn:    conn,
+		counter: counter,
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	counter prometheus.Counter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
 	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
 )
 
@@ -21,30 +23,49 @@ var (
 )
 
 const (
-	COM_QUIT             = 0x01
-	COM_INIT_DB          = 0x02
-	COM_QUERY            = 0x03
-	COM_FIELD_LIST       = 0x04
-	COM_CREATE_DB        = 0x05
-	COM_DROP_DB          = 0x06
-	COM_REFRESH          = 0x07
-	COM_STATISTICS       = 0x09
-	COM_PROCESS_INFO     = 0x0a
-	COM_CONNECT          = 0x0b
-	COM_PROCESS_KILL     = 0x0c
-	COM_DEBUG            = 0x0d
-	COM_PING             = 0x0e
-	COM_CHANGE_USER      = 0x11
-	COM_RESET_CONNECTION = 0x1f
-	COM_STMT_PREPARE     = 0x16
-	COM_STMT_EXECUTE     = 0x17
-	COM_STMT_CLOSE       = 0x19
+	COM_QUIT                = 0x01
+	COM_INIT_DB             = 0x02
+	COM_QUERY               = 0x03
+	COM_FIELD_LIST          = 0x04
+	COM_CREATE_DB           = 0x05
+	COM_DROP_DB             = 0x06
+	COM_REFRESH             = 0x07
+	COM_STATISTICS          = 0x09
+	COM_PROCESS_INFO        = 0x0a
+	COM_CONNECT             = 0x0b
+	COM_PROCESS_KILL        = 0x0c
+	COM_DEBUG               = 0x0d
+	COM_PING                = 0x0e
+	COM_CHANGE_USER         = 0x11
+	COM_RESET_CONNECTION    = 0x1f
+	COM_STMT_PREPARE        = 0x16
+	COM_STMT_EXECUTE        = 0x17
+	COM_STMT_SEND_LONG_DATA = 0x18
+	COM_STMT_CLOSE          = 0x19
+	COM_STMT_RESET          = 0x1a
+	COM_STMT_FETCH          = 0x1c
 )
 
-func copyAndInspectCommands(src, dst net.Conn, connectionState *types.ConnectionState) error {
+func copyAndInspectCommands(src, dst net.Conn, connectionState *types.ConnectionState, inspect bool) error {
+	if !inspect {
+		// the client started tls that the proxy can't terminate, don't try to frame it
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
 	buffer := make([]byte, 0, 8192)
+	decompressedBuffer := make([]byte, 0, 8192)
 	tempBuffer := make([]byte, 4096)
 
+	inspectPayload := func(sequenceID byte, payload []byte) {
+		if err := inspectCommand(sequenceID, payload, connectionState); err != nil {
+			if errors.Cause(err) != ErrNonQueryData {
+				log.Printf("Error extracting query: %v", err)
+				metrics.ParseErrors.WithLabelValues(string(daemontypes.Mysql), "command").Inc()
+			}
+		}
+	}
+
 	for {
 		n, err := src.Read(tempBuffer)
 		if err != nil {
@@ -57,34 +78,41 @@ func copyAndInspectCommands(src, dst net.Conn, connectionState *types.Connection
 		buffer = append(buffer, tempBuffer[:n]...)
 
 		for {
-			query, isPreparedStatement, bytesRead, err := extractQuery(buffer, connectionState)
-			if err != nil {
-				if errors.Cause(err) == ErrNonQueryDataOrIncompletePacket {
+			compression := getCompression(connectionState)
+			if compression == types.CompressionNone {
+				payload, sequenceID, bytesRead, ok := parseNextPayload(buffer)
+				if !ok {
 					break
-				} else if errors.Cause(err) != ErrNonQueryData {
-					log.Printf("Error extracting query: %v", err)
 				}
+
+				inspectPayload(sequenceID, payload)
 				buffer = buffer[bytesRead:]
 				continue
 			}
 
+			// the original bytes are forwarded as is, only this copy is decompressed
+			frame, bytesRead, ok, err := decompressNextFrame(buffer, compression)
+			if !ok {
+				break
+			}
 			buffer = buffer[bytesRead:]
 
-			if err == nil {
-				cleanedQuery, err := cleanQuery(query)
-				if err != nil {
-					log.Printf("Error cleaning query: %v", err)
-				} else {
-					if strings.ToLower(cleanedQuery) == "select connection_id ( ) as pid" {
-						// Ignore this query
-					}
-
-					connectionState.CurrentQuery = &heartbeattypes.CurrentQuery{
-						ExecutionStartedAt:  time.Now().UnixNano(),
-						Query:               cleanedQuery,
-						IsPreparedStatement: isPreparedStatement,
-					}
+			if err != nil {
+				log.Printf("Error decompressing command: %v", err)
+				metrics.ParseErrors.WithLabelValues(string(daemontypes.Mysql), "decompress").Inc()
+				decompressedBuffer = decompressedBuffer[:0]
+				continue
+			}
+
+			decompressedBuffer = append(decompressedBuffer, frame...)
+			for {
+				payload, sequenceID, bytesRead, ok := parseNextPayload(decompressedBuffer)
+				if !ok {
+					break
 				}
+
+				inspectPayload(sequenceID, payload)
+				decompressedBuffer = decompressedBuffer[bytesRead:]
 			}
 		}
 
@@ -96,62 +124,154 @@ func copyAndInspectCommands(src, dst net.Conn, connectionState *types.Connection
 	return nil
 }
 
-// extractQuery returns the query and an id we can use to map it later
-// the id is deterministic
-// the bool indicates if the query is a prepared statement
-func extractQuery(data []byte, connectionState *types.ConnectionState) (string, bool, int, error) {
-	if len(data) < 4 {
-		return "", false, 0, ErrNonQueryDataOrIncompletePacket // Not enough data for the header
+// inspectCommand updates the connection state for a single, reassembled payload
+// sent by the client. every command that the server answers is queued so the
+// response can be matched to it
+func inspectCommand(sequenceID byte, payload []byte, connectionState *types.ConnectionState) error {
+	// commands always start a new sequence. anything else is part of the
+	// handshake, an auth exchange, or a LOAD DATA LOCAL INFILE upload
+	if len(payload) == 0 {
+		return ErrNonQueryData
 	}
 
-	payloadLength := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
-	totalPacketLength := 4 + payloadLength
+	connectionState.Lock()
+	isAuthenticated := connectionState.IsAuthenticated
+	if !isAuthenticated && connectionState.ClientCapabilities == 0 {
+		// the first packet from the client is the handshake response
+		connectionState.ClientCapabilities = parseClientCapabilities(payload)
+	}
+	connectionState.Unlock()
 
-	if len(data) < totalPacketLength {
-		return "", false, 0, ErrNonQueryDataOrIncompletePacket
+	if !isAuthenticated || sequenceID != 0 {
+		return ErrNonQueryData
 	}
 
-	switch data[4] {
+	command := payload[0]
+
+	switch command {
 	case COM_QUERY:
-		connectionState.ReceivedSimpleQuery = true
-		connectionState.RowCount = 0
-		query := strings.TrimSpace(string(data[5:]))
-		return query, false, totalPacketLength, nil
+		pendingCommand := &types.PendingCommand{
+			Command: command,
+		}
+
+		query := strings.TrimSpace(string(payload[1:]))
+		cleanedQuery, err := cleanQuery(query)
+		if err != nil {
+			log.Printf("Error cleaning query: %v", err)
+		} else {
+			pendingCommand.Query = &heartbeattypes.CurrentQuery{
+				ExecutionStartedAt:  time.Now().UnixNano(),
+				Query:               cleanedQuery,
+				IsPreparedStatement: false,
+			}
+		}
+
+		enqueueCommand(connectionState, pendingCommand)
+		return nil
+
 	case COM_STMT_PREPARE:
-		query := strings.TrimSpace(string(data[5:]))
-		connectionState.PreparedStatement = &types.PreparedStatement{
-			Query: query,
-			ID:    -1,
+		query := strings.TrimSpace(string(payload[1:]))
+		cleanedQuery, err := cleanQuery(query)
+		if err != nil {
+			log.Printf("Error cleaning query: %v", err)
+			cleanedQuery = ""
 		}
-		connectionState.RowCount = 0
-		return "", false, totalPacketLength, ErrNonQueryData // really this should be after we find the statement in COM_STMT_EXECUTE
+
+		// the statement id is only known once the server responds
+		enqueueCommand(connectionState, &types.PendingCommand{
+			Command:      command,
+			PrepareQuery: cleanedQuery,
+		})
+		return ErrNonQueryData
+
 	case COM_STMT_EXECUTE:
-		// find the prepared statement with the same id, log that this query was executed
-		if len(data) < 9 {
-			return "", false, totalPacketLength, ErrNonQueryDataOrIncompletePacket
+		if len(payload) < 5 {
+			return ErrNonQueryDataOrIncompletePacket
 		}
-		stmtID := binary.LittleEndian.Uint32(data[5:9])
+		stmtID := binary.LittleEndian.Uint32(payload[1:5])
 
-		if connectionState.PreparedStatement == nil {
-			return "", false, totalPacketLength, ErrUnknownPreparedStatement
+		connectionState.Lock()
+		defer connectionState.Unlock()
+
+		// always queue the execute so the response stays aligned, even if it
+		// can't be attributed to a statement
+		pendingCommand := &types.PendingCommand{
+			Command: command,
+		}
+		connectionState.PendingCommands = append(connectionState.PendingCommands, pendingCommand)
+
+		preparedStatement, ok := connectionState.PreparedStatements[stmtID]
+		if !ok {
+			return errors.Wrapf(ErrUnknownPreparedStatement, "execute %d", stmtID)
 		}
-		if connectionState.PreparedStatement != nil && connectionState.PreparedStatement.ID == int(stmtID) {
-			connectionState.PreparedStatement.IsExecuted = true
-			return connectionState.PreparedStatement.Query, true, totalPacketLength, nil
+
+		if preparedStatement.Query != "" {
+			pendingCommand.Query = &heartbeattypes.CurrentQuery{
+				ExecutionStartedAt:  time.Now().UnixNano(),
+				Query:               preparedStatement.Query,
+				IsPreparedStatement: true,
+			}
 		}
+		return nil
 
-		return "", false, totalPacketLength, ErrUnknownPreparedStatement
+	case COM_STMT_FETCH:
+		// a fetch on an open cursor responds with rows and a terminating EOF,
+		// without column definitions
+		enqueueCommand(connectionState, &types.PendingCommand{
+			Command:             command,
+			State:               types.ResponseStateRows,
+			SeenIntermediateEOF: true,
+		})
+		return ErrNonQueryData
 
 	case COM_STMT_CLOSE:
-		connectionState.PreparedStatement = nil
-		return "", false, totalPacketLength, ErrNonQueryData
-
-	case COM_QUIT, COM_INIT_DB, COM_FIELD_LIST, COM_CREATE_DB,
-		COM_DROP_DB, COM_REFRESH, COM_STATISTICS, COM_PROCESS_INFO,
-		COM_CONNECT, COM_PROCESS_KILL, COM_DEBUG, COM_PING,
-		COM_CHANGE_USER, COM_RESET_CONNECTION:
-		return "", false, totalPacketLength, ErrNonQueryData
+		if len(payload) < 5 {
+			return ErrNonQueryDataOrIncompletePacket
+		}
+		stmtID := binary.LittleEndian.Uint32(payload[1:5])
+
+		connectionState.Lock()
+		defer connectionState.Unlock()
+
+		// there is no response to a close
+		delete(connectionState.PreparedStatements, stmtID)
+		return ErrNonQueryData
+
+	case COM_STMT_SEND_LONG_DATA, COM_QUIT:
+		// no response is sent for these
+		return ErrNonQueryData
+
+	case COM_FIELD_LIST:
+		enqueueCommand(connectionState, &types.PendingCommand{
+			Command: command,
+			State:   types.ResponseStateFieldList,
+		})
+		return ErrNonQueryData
+
+	case COM_CHANGE_USER, COM_RESET_CONNECTION:
+		// the server deallocates every prepared statement for the session
+		connectionState.Lock()
+		connectionState.PreparedStatements = map[uint32]*types.PreparedStatement{}
+		connectionState.Unlock()
+
+		enqueueCommand(connectionState, &types.PendingCommand{
+			Command: command,
+		})
+		return ErrNonQueryData
+
+	default:
+		// COM_STMT_RESET, COM_PING, COM_INIT_DB and the rest all get a response
+		// that must be consumed, even though we don't report on them
+		enqueueCommand(connectionState, &types.PendingCommand{
+			Command: command,
+		})
+		return ErrNonQueryData
 	}
+}
+
+func enqueueCommand(connectionState *types.ConnectionState, pendingCommand *types.PendingCommand) {
+	connectionState.Lock()
+	defer connectionState.Unlock()
 
-	return "", false, totalPacketLength, ErrNonQueryData
+	connectionState.PendingCommands = append(connectionState.PendingCommands, pendingCommand)
 }
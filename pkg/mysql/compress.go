@@ -0,0 +1,126 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
+)
+
+const (
+	CLIENT_COMPRESS                   = 0x00000020
+	CLIENT_PROTOCOL_41                = 0x00000200
+	CLIENT_DEPRECATE_EOF              = 0x01000000
+	CLIENT_ZSTD_COMPRESSION_ALGORITHM = 0x04000000
+
+	compressedHeaderLength = 7
+)
+
+var (
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+	zstdDecoderOnce sync.Once
+)
+
+// parseClientCapabilities returns the capability flags from a client
+// handshake response payload
+func parseClientCapabilities(payload []byte) uint32 {
+	if len(payload) < 2 {
+		return 0
+	}
+
+	capabilities := uint32(binary.LittleEndian.Uint16(payload[0:2]))
+	if capabilities&CLIENT_PROTOCOL_41 != 0 && len(payload) >= 4 {
+		capabilities = binary.LittleEndian.Uint32(payload[0:4])
+	}
+
+	return capabilities
+}
+
+// compressionFromCapabilities returns the algorithm that will be used after
+// authentication, based on the flags the client sent in its handshake response.
+// the client only sets these when the server advertised them
+func compressionFromCapabilities(capabilities uint32) types.CompressionAlgorithm {
+	if capabilities&CLIENT_ZSTD_COMPRESSION_ALGORITHM != 0 {
+		return types.CompressionZstd
+	}
+	if capabilities&CLIENT_COMPRESS != 0 {
+		return types.CompressionZlib
+	}
+	return types.CompressionNone
+}
+
+// decompressNextFrame decompresses the first complete compressed packet in data.
+// it returns the decompressed bytes, which are a stream of regular packets that
+// can end part way through one, and the number of bytes of data it used
+func decompressNextFrame(data []byte, compression types.CompressionAlgorithm) ([]byte, int, bool, error) {
+	if len(data) < compressedHeaderLength {
+		return nil, 0, false, nil
+	}
+
+	compressedLength := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	uncompressedLength := int(data[4]) | int(data[5])<<8 | int(data[6])<<16
+
+	frameLength := compressedHeaderLength + compressedLength
+	if len(data) < frameLength {
+		return nil, 0, false, nil
+	}
+
+	body := data[compressedHeaderLength:frameLength]
+
+	// small payloads are sent without compressing them
+	if uncompressedLength == 0 {
+		return body, frameLength, true, nil
+	}
+
+	switch compression {
+	case types.CompressionZlib:
+		reader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, frameLength, true, fmt.Errorf("zlib reader: %v", err)
+		}
+		defer reader.Close()
+
+		decompressed := make([]byte, uncompressedLength)
+		if _, err := io.ReadFull(reader, decompressed); err != nil {
+			return nil, frameLength, true, fmt.Errorf("zlib read: %v", err)
+		}
+		return decompressed, frameLength, true, nil
+
+	case types.CompressionZstd:
+		decoder, err := getZstdDecoder()
+		if err != nil {
+			return nil, frameLength, true, fmt.Errorf("zstd decoder: %v", err)
+		}
+
+		decompressed, err := decoder.DecodeAll(body, make([]byte, 0, uncompressedLength))
+		if err != nil {
+			return nil, frameLength, true, fmt.Errorf("zstd decode: %v", err)
+		}
+		return decompressed, frameLength, true, nil
+	}
+
+	return nil, frameLength, true, fmt.Errorf("unknown compression algorithm %d", compression)
+}
+
+// getZstdDecoder returns a shared decoder, DecodeAll is safe for concurrent use
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil)
+	})
+
+	return zstdDecoder, zstdDecoderErr
+}
+
+// getCompression returns the compression in use for the connection
+func getCompression(connectionState *types.ConnectionState) types.CompressionAlgorithm {
+	connectionState.Lock()
+	defer connectionState.Unlock()
+
+	return connectionState.Compression
+}
@@ -0,0 +1,132 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
+)
+
+// compressedFrame wraps body in a compressed packet header. uncompressedLength
+// is 0 when the body is sent as is
+func compressedFrame(body []byte, uncompressedLength int) []byte {
+	header := []byte{
+		byte(len(body)), byte(len(body) >> 8), byte(len(body) >> 16),
+		0,
+		byte(uncompressedLength), byte(uncompressedLength >> 8), byte(uncompressedLength >> 16),
+	}
+	return append(header, body...)
+}
+
+func zlibFrame(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressedFrame(b.Bytes(), len(data))
+}
+
+func zstdFrame(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	return compressedFrame(encoder.EncodeAll(data, nil), len(data))
+}
+
+func TestDecompressNextFrame(t *testing.T) {
+	// two packets, the second split across frames
+	packets := append(packet(0, queryCommand("select 1")), packet(0, queryCommand("select 2"))...)
+	stream := packets[:len(packets)-3]
+
+	tests := []struct {
+		name          string
+		data          []byte
+		compression   types.CompressionAlgorithm
+		wantFrame     []byte
+		wantBytesRead int
+		wantOK        bool
+		wantErr       bool
+	}{
+		{
+			name:        "partial header",
+			data:        compressedFrame(stream, 0)[:5],
+			compression: types.CompressionZlib,
+		},
+		{
+			name:        "partial body",
+			data:        zlibFrame(t, stream)[:10],
+			compression: types.CompressionZlib,
+		},
+		{
+			name:          "uncompressed body",
+			data:          compressedFrame(stream, 0),
+			compression:   types.CompressionZlib,
+			wantFrame:     stream,
+			wantBytesRead: compressedHeaderLength + len(stream),
+			wantOK:        true,
+		},
+		{
+			name:          "zlib",
+			data:          zlibFrame(t, stream),
+			compression:   types.CompressionZlib,
+			wantFrame:     stream,
+			wantBytesRead: len(zlibFrame(t, stream)),
+			wantOK:        true,
+		},
+		{
+			name:          "zlib followed by another frame",
+			data:          append(zlibFrame(t, stream), compressedFrame(packets[len(stream):], 0)...),
+			compression:   types.CompressionZlib,
+			wantFrame:     stream,
+			wantBytesRead: len(zlibFrame(t, stream)),
+			wantOK:        true,
+		},
+		{
+			name:          "zstd",
+			data:          zstdFrame(t, stream),
+			compression:   types.CompressionZstd,
+			wantFrame:     stream,
+			wantBytesRead: len(zstdFrame(t, stream)),
+			wantOK:        true,
+		},
+		{
+			name:          "corrupt zlib",
+			data:          compressedFrame([]byte("not zlib"), len(stream)),
+			compression:   types.CompressionZlib,
+			wantBytesRead: compressedHeaderLength + len("not zlib"),
+			wantOK:        true,
+			wantErr:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, bytesRead, ok, err := decompressNextFrame(test.data, test.compression)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v; want error %v", err, test.wantErr)
+			}
+			if ok != test.wantOK {
+				t.Fatalf("got ok %v; want %v", ok, test.wantOK)
+			}
+			if bytesRead != test.wantBytesRead {
+				t.Errorf("got %d bytes read; want %d", bytesRead, test.wantBytesRead)
+			}
+			if !bytes.Equal(frame, test.wantFrame) {
+				t.Errorf("got frame %q; want %q", frame, test.wantFrame)
+			}
+		})
+	}
+}
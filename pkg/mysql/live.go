@@ -1,25 +1,17 @@
 package mysql
 
 import (
-	"database/sql"
-	"fmt"
-
 	_ "github.com/go-sql-driver/mysql"
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/live"
 )
 
-var (
-	DB *sql.DB
-)
-
-func GetMysqlConnection(uri string) (*sql.DB, error) {
-	var db *sql.DB
-	var err error
-	db, err = sql.Open("mysql", uri)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open mysql connection: %v", err)
-	}
-
-	DB = db
-
-	return db, nil
+// OpenLiveConnection opens the pool that the schema is read with
+func OpenLiveConnection(opts daemontypes.DaemonOpts) (*live.Conn, error) {
+	return live.Open(live.Options{
+		DriverName:          "mysql",
+		URI:                 opts.LiveConnectionURI,
+		URIFile:             opts.LiveConnectionURIFile,
+		HealthCheckInterval: opts.LiveConnectionHealthCheckInterval,
+	})
 }
@@ -0,0 +1,40 @@
+package mysql
+
+const (
+	maxPacketPayloadLength = 0xFFFFFF
+)
+
+// parseNextPayload returns the payload of the first complete logical packet in
+// data, along with its sequence id and the number of bytes it used. payloads of
+// 16MB or more are split into packets of 0xFFFFFF bytes, followed by a shorter
+// (possibly empty) packet, and are reassembled here
+func parseNextPayload(data []byte) (payload []byte, sequenceID byte, length int, ok bool) {
+	offset := 0
+	for {
+		// Check if we have enough data to determine the length
+		if len(data)-offset < 4 {
+			return nil, 0, 0, false
+		}
+
+		payloadLength := int(data[offset]) | int(data[offset+1])<<8 | int(data[offset+2])<<16
+		if len(data)-offset < 4+payloadLength {
+			return nil, 0, 0, false
+		}
+
+		chunk := data[offset+4 : offset+4+payloadLength]
+		if offset == 0 {
+			sequenceID = data[3]
+		}
+		offset += 4 + payloadLength
+
+		if payloadLength < maxPacketPayloadLength {
+			if payload == nil {
+				// the common case, a single packet
+				return chunk, sequenceID, offset, true
+			}
+			return append(payload, chunk...), sequenceID, offset, true
+		}
+
+		payload = append(payload, chunk...)
+	}
+}
@@ -0,0 +1,91 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseNextPayload(t *testing.T) {
+	full := bytes.Repeat([]byte{'a'}, maxPacketPayloadLength)
+	query := queryCommand("select 1")
+
+	tests := []struct {
+		name           string
+		data           []byte
+		wantPayload    []byte
+		wantSequenceID byte
+		wantLength     int
+		wantOK         bool
+	}{
+		{
+			name: "partial header",
+			data: packet(0, query)[:3],
+		},
+		{
+			name: "partial payload",
+			data: packet(0, query)[:6],
+		},
+		{
+			name:           "single packet",
+			data:           packet(3, query),
+			wantPayload:    query,
+			wantSequenceID: 3,
+			wantLength:     4 + len(query),
+			wantOK:         true,
+		},
+		{
+			name:        "pipelined",
+			data:        append(packet(0, query), packet(0, queryCommand("select 2"))...),
+			wantPayload: query,
+			wantLength:  4 + len(query),
+			wantOK:      true,
+		},
+		{
+			name:           "empty payload",
+			data:           packet(1, []byte{}),
+			wantPayload:    []byte{},
+			wantSequenceID: 1,
+			wantLength:     4,
+			wantOK:         true,
+		},
+		{
+			name: "split without its trailer",
+			data: packet(0, full),
+		},
+		{
+			name:        "split with a short trailer",
+			data:        append(packet(0, full), packet(1, []byte("bc"))...),
+			wantPayload: append(append([]byte{}, full...), "bc"...),
+			wantLength:  4 + maxPacketPayloadLength + 4 + 2,
+			wantOK:      true,
+		},
+		{
+			name:        "split with an empty trailer",
+			data:        append(append(packet(0, full), packet(1, []byte{})...), packet(0, query)...),
+			wantPayload: full,
+			wantLength:  4 + maxPacketPayloadLength + 4,
+			wantOK:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, sequenceID, length, ok := parseNextPayload(test.data)
+			if ok != test.wantOK {
+				t.Fatalf("got ok %v; want %v", ok, test.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !bytes.Equal(payload, test.wantPayload) {
+				t.Errorf("got a %d byte payload; want %d bytes", len(payload), len(test.wantPayload))
+			}
+			if sequenceID != test.wantSequenceID {
+				t.Errorf("got sequence id %d; want %d", sequenceID, test.wantSequenceID)
+			}
+			if length != test.wantLength {
+				t.Errorf("got length %d; want %d", length, test.wantLength)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package mysql
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -10,63 +11,125 @@ import (
 	"sync"
 
 	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/drain"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/health"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/netutil"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/tlsconfig"
 )
 
-func RunProxy(ctx context.Context, opts daemontypes.DaemonOpts) {
+// RunProxy accepts connections until the context is cancelled, then drains
+// them. it returns an error when the proxy can't start or can't keep accepting
+func RunProxy(ctx context.Context, opts daemontypes.DaemonOpts) error {
 	address := fmt.Sprintf("%s:%v", opts.BindAddress, opts.BindPort)
 	upstreamAddress := fmt.Sprintf("%s:%v", opts.UpstreamAddress, opts.UpstreamPort)
 
 	fmt.Printf("Listening on %s, proxying to %s\n", address, upstreamAddress)
 
+	serverTLSConfig, err := tlsconfig.ServerConfig(opts)
+	if err != nil {
+		return &daemontypes.ProxyError{DBMS: daemontypes.Mysql, Op: "load tls config", Err: err}
+	}
+	upstreamTLSConfig, err := tlsconfig.UpstreamConfig(opts)
+	if err != nil {
+		return &daemontypes.ProxyError{DBMS: daemontypes.Mysql, Op: "load upstream tls config", Err: err}
+	}
+
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		panic(err)
+		return &daemontypes.ProxyError{DBMS: daemontypes.Mysql, Op: "listen", Address: address, Err: err}
 	}
 	defer listener.Close()
 
+	// closing the listener is the only way to unblock Accept
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	health.SetListening(true)
+
+	var acceptErr error
+	connections := drain.NewGroup()
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			localConn, err := listener.Accept()
-			if err != nil {
-				panic(err)
+		localConn, err := netutil.Accept(ctx, listener)
+		if err != nil {
+			if ctx.Err() == nil {
+				acceptErr = &daemontypes.ProxyError{DBMS: daemontypes.Mysql, Op: "accept", Address: address, Err: err}
 			}
-			go handleMysqlConnection(localConn, upstreamAddress)
+			break
 		}
+
+		trackedConn := connections.Add(localConn)
+		go handleMysqlConnection(localConn, trackedConn, upstreamAddress, serverTLSConfig, upstreamTLSConfig)
+	}
+
+	health.SetListening(false)
+
+	log.Printf("Draining %d mysql connections", connections.Len())
+	if closed := connections.Drain(opts.DrainTimeout); closed > 0 {
+		log.Printf("Closed %d connections that were still busy after %s", closed, opts.DrainTimeout)
 	}
+
+	return acceptErr
 }
 
-func handleMysqlConnection(localConn net.Conn, targetAddress string) {
+func handleMysqlConnection(localConn net.Conn, trackedConn *drain.Conn, targetAddress string, serverTLSConfig *tls.Config, upstreamTLSConfig *tls.Config) {
+	defer trackedConn.Done()
+
+	metrics.Connections.WithLabelValues(string(daemontypes.Mysql)).Inc()
+	metrics.ActiveConnections.WithLabelValues(string(daemontypes.Mysql)).Inc()
+	defer metrics.ActiveConnections.WithLabelValues(string(daemontypes.Mysql)).Dec()
+
 	targetConn, err := net.Dial("tcp", targetAddress)
 	if err != nil {
 		log.Printf("Failed to connect to target address %s: %v", targetAddress, err)
 		localConn.Close()
 		return
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
+	health.RecordUpstreamDial()
+	trackedConn.AddCloser(targetConn)
 
 	connectionState, err := types.NewConnectionState()
 	if err != nil {
 		log.Printf("Error creating connection state: %v", err)
 		localConn.Close()
+		targetConn.Close()
+		return
+	}
+	negotiatedLocalConn, negotiatedTargetConn, inspect, err := negotiateTLS(localConn, targetConn, serverTLSConfig, upstreamTLSConfig, connectionState)
+	if err != nil {
+		log.Printf("Error negotiating tls: %v", err)
+		localConn.Close()
+		targetConn.Close()
 		return
 	}
+	localConn, targetConn = negotiatedLocalConn, negotiatedTargetConn
+
+	// an opaque stream can't be known to be idle, it's only closed when the drain times out
+	if inspect {
+		trackedConn.SetIdle(func() bool {
+			return isIdle(connectionState)
+		})
+	}
+
+	localConn = metrics.CountReads(localConn, metrics.BytesProxied.WithLabelValues(string(daemontypes.Mysql), metrics.DirectionClientToUpstream))
+	targetConn = metrics.CountReads(targetConn, metrics.BytesProxied.WithLabelValues(string(daemontypes.Mysql), metrics.DirectionUpstreamToClient))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		if err := copyAndInspectCommands(localConn, targetConn, connectionState); err != nil {
+		if err := copyAndInspectCommands(localConn, targetConn, connectionState, inspect); err != nil {
 			log.Printf("Error in data transfer from local to target: %v", err)
 		}
 	}()
 
 	go func() {
 		defer wg.Done()
-		if err := copyAndInspectResponses(targetConn, localConn, connectionState); err != nil {
+		if err := copyAndInspectResponses(targetConn, localConn, connectionState, inspect); err != nil {
 			if errors.Is(err, io.EOF) {
 				// safe to ignore, the client went away
 				return
@@ -80,3 +143,14 @@ func handleMysqlConnection(localConn net.Conn, targetAddress string) {
 	localConn.Close()
 	targetConn.Close()
 }
+
+// isIdle returns true when the connection is authenticated and isn't waiting
+// on a response or in a transaction, so closing it won't interrupt the client
+func isIdle(connectionState *types.ConnectionState) bool {
+	connectionState.Lock()
+	defer connectionState.Unlock()
+
+	return connectionState.IsAuthenticated &&
+		len(connectionState.PendingCommands) == 0 &&
+		connectionState.CurrentTransaction == nil
+}
@@ -2,11 +2,14 @@ package mysql
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"log"
 	"net"
 
-	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat"
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
 )
 
@@ -20,13 +23,31 @@ const (
 	MysqlPacketTypeHandshakeResponse = 0x01
 	MysqlPacketTypeColumnDefinition  = 0x03
 	MysqlPacketTypeComFieldList      = 0x04
+	MysqlPacketTypeERRPacket         = 0xFF
+	MysqlPacketTypeLocalInfile       = 0xFB
+)
+
+const (
+	SERVER_STATUS_IN_TRANS          = 0x0001
+	SERVER_STATUS_AUTOCOMMIT        = 0x0002
+	SERVER_MORE_RESULTS_EXISTS      = 0x0008
+	SERVER_STATUS_CURSOR_EXISTS     = 0x0040
+	SERVER_STATUS_LAST_ROW_SENT     = 0x0080
+	SERVER_STATUS_IN_TRANS_READONLY = 0x2000
 )
 
 // copyAndInspectResponse copies data from src to dst and parses the MySQL response
 // mysql keeps the connection alive though, so the scope of this function
 // is likely > 1 query
-func copyAndInspectResponses(src, dst net.Conn, connectionState *types.ConnectionState) error {
+func copyAndInspectResponses(src, dst net.Conn, connectionState *types.ConnectionState, inspect bool) error {
+	if !inspect {
+		// the client started tls that the proxy can't terminate, don't try to frame it
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
 	var accum bytes.Buffer
+	var decompressed bytes.Buffer
 	buf := make([]byte, 8192)
 
 	for {
@@ -43,90 +64,342 @@ func copyAndInspectResponses(src, dst net.Conn, connectionState *types.Connectio
 		// Continue to read every possible complete packet from accum
 		for {
 			data := accum.Bytes()
-			count, ok := parseNextPacket(data)
+
+			compression := getCompression(connectionState)
+			if compression == types.CompressionNone {
+				payload, _, count, ok := parseNextPayload(data)
+				if !ok {
+					break
+				}
+
+				// process this packet before forwarding, the payload may point into accum
+				if err := parseFullResponsePacket(payload, connectionState); err != nil {
+					metrics.ParseErrors.WithLabelValues(string(daemontypes.Mysql), "response").Inc()
+					return err
+				}
+
+				_, err = dst.Write(data[:count])
+				if err != nil {
+					log.Printf("Error writing to client: %v", err)
+					return err
+				}
+
+				// Remove the processed packet from the buffer
+				accum.Next(count)
+				continue
+			}
+
+			// the original bytes are forwarded as is, only this copy is decompressed
+			frame, count, ok, err := decompressNextFrame(data, compression)
 			if !ok {
 				break
 			}
 
-			dataToForward := data[:count]
-
-			_, err = dst.Write(dataToForward)
 			if err != nil {
-				log.Printf("Error writing to client: %v", err)
-				return err
+				log.Printf("Error decompressing response: %v", err)
+				metrics.ParseErrors.WithLabelValues(string(daemontypes.Mysql), "decompress").Inc()
+				decompressed.Reset()
+			} else {
+				decompressed.Write(frame)
+				for {
+					payload, _, payloadCount, ok := parseNextPayload(decompressed.Bytes())
+					if !ok {
+						break
+					}
+
+					if err := parseFullResponsePacket(payload, connectionState); err != nil {
+						metrics.ParseErrors.WithLabelValues(string(daemontypes.Mysql), "response").Inc()
+						return err
+					}
+					decompressed.Next(payloadCount)
+				}
 			}
 
-			// process this packet
-			if err := parseFullResponsePacket(dataToForward, connectionState); err != nil {
+			_, err = dst.Write(data[:count])
+			if err != nil {
+				log.Printf("Error writing to client: %v", err)
 				return err
 			}
 
-			// Remove the processed packet from the buffer
 			accum.Next(count)
 		}
 	}
 }
 
-func parseNextPacket(data []byte) (length int, ok bool) {
-	// Check if we have enough data to determine the length
-	if len(data) < 4 {
-		return 0, false
+func parseFullResponsePacket(payload []byte, connectionState *types.ConnectionState) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	connectionState.Lock()
+	defer connectionState.Unlock()
+
+	if !connectionState.IsAuthenticated {
+		// the server ends authentication with an OK, after which the compressed
+		// protocol is used if the client negotiated it
+		if payload[0] == MysqlPacketTypeOKPacket {
+			connectionState.IsAuthenticated = true
+			connectionState.Compression = compressionFromCapabilities(connectionState.ClientCapabilities)
+		}
+		return nil
 	}
-	length = int(data[0]) | int(data[1])<<8 | int(data[2])<<16
 
-	// Check if we have a full packet
-	if len(data) >= length+4 {
-		return length + 4, true
+	// a packet that doesn't belong to the command at the head (the optional
+	// trailing EOF of a prepare) pops it and is offered to the next one
+	for len(connectionState.PendingCommands) > 0 {
+		pendingCommand := connectionState.PendingCommands[0]
+
+		consumed, done := handleResponsePacket(payload, pendingCommand, connectionState)
+		if done {
+			connectionState.PendingCommands = connectionState.PendingCommands[1:]
+		}
+		if consumed {
+			return nil
+		}
 	}
 
-	return 0, false
+	// nothing is pending during the handshake, so there's nothing to track
+	return nil
 }
 
-func parseFullResponsePacket(data []byte, connectionState *types.ConnectionState) error {
-	payloadStartIndex := 4
-	packetType := data[payloadStartIndex]
-
-	switch packetType {
-	case MysqlPacketTypeOKPacket:
-		if len(data) >= 9 {
-			if connectionState.PreparedStatement != nil {
-				if !connectionState.PreparedStatement.IsExecuted {
-					stmtID := uint32(data[5]) | uint32(data[6])<<8 | uint32(data[7])<<16 | uint32(data[8])<<24
-					connectionState.PreparedStatement.ID = int(stmtID)
-				} else if connectionState.PreparedStatement.IsExecuted {
-					connectionState.RowCount++
-					return nil
-				}
+// handleResponsePacket advances the response state of the pending command.
+// consumed reports if the packet was part of this response, and done reports
+// if the response is now complete
+func handleResponsePacket(payload []byte, pendingCommand *types.PendingCommand, connectionState *types.ConnectionState) (consumed bool, done bool) {
+	packetType := payload[0]
+
+	switch pendingCommand.State {
+	case types.ResponseStateFirstPacket:
+		switch {
+		case packetType == MysqlPacketTypeOKPacket:
+			if pendingCommand.Command == COM_STMT_PREPARE {
+				return true, handlePrepareOK(payload, pendingCommand, connectionState)
+			}
+
+			affectedRows, _, statusFlags := parseOKPacket(payload)
+			pendingCommand.RowCount += int64(affectedRows)
+			if statusFlags&SERVER_MORE_RESULTS_EXISTS != 0 {
+				return true, false
+			}
+
+			completeCommand(pendingCommand, connectionState, statusFlags)
+			return true, true
+
+		case packetType == MysqlPacketTypeERRPacket:
+			failCommand(pendingCommand, connectionState, parseERRPacket(payload))
+			return true, true
+
+		case pendingCommand.Command == COM_CHANGE_USER:
+			// auth switch and auth more data packets, wait for the OK or ERR
+			return true, false
+
+		case packetType == MysqlPacketTypeLocalInfile:
+			// the client uploads the file, then the server sends an OK
+			return true, false
+
+		case isEOFPacket(payload), pendingCommand.Command == COM_STATISTICS:
+			return true, true
+
+		default:
+			columnCount, _ := readLengthEncodedInteger(payload)
+			pendingCommand.State = types.ResponseStateColumnDefinitions
+			pendingCommand.RemainingDefinitions = int(columnCount)
+			pendingCommand.SeenIntermediateEOF = false
+			if columnCount == 0 {
+				pendingCommand.State = types.ResponseStateRows
 			}
+			return true, false
 		}
 
-	case MysqlPacketTypeEOFPacket:
-		connectionState.EOFCount++
+	case types.ResponseStateColumnDefinitions:
+		pendingCommand.RemainingDefinitions--
+		if pendingCommand.RemainingDefinitions <= 0 {
+			pendingCommand.State = types.ResponseStateRows
+		}
+		return true, false
 
-		if connectionState.PreparedStatement != nil {
-			if connectionState.PreparedStatement.IsExecuted {
-				connectionState.PreparedStatement.CountEOFReceived++
-				if connectionState.PreparedStatement.CountEOFReceived == 2 {
-					heartbeat.CompleteCurrentQuery(connectionState.CurrentQuery, connectionState.RowCount)
-				}
+	case types.ResponseStateRows:
+		switch {
+		case packetType == MysqlPacketTypeERRPacket:
+			// the query failed part way through the result set, like when it's killed
+			failCommand(pendingCommand, connectionState, parseERRPacket(payload))
+			return true, true
+
+		case isEOFPacket(payload) && !pendingCommand.SeenIntermediateEOF:
+			// without CLIENT_DEPRECATE_EOF the column definitions end with an EOF
+			pendingCommand.SeenIntermediateEOF = true
+
+			_, statusFlags := parseEOFPacket(payload)
+			if statusFlags&SERVER_STATUS_CURSOR_EXISTS != 0 {
+				// the rows will come from COM_STMT_FETCH
+				completeCommand(pendingCommand, connectionState, statusFlags)
+				return true, true
 			}
+			return true, false
+
+		case isEOFPacket(payload):
+			_, statusFlags := parseEOFPacket(payload)
+			return true, completeResultSet(pendingCommand, connectionState, statusFlags)
+
+		case packetType == MysqlPacketTypeEOFPacket && len(payload) < 0xFFFFFF:
+			// with CLIENT_DEPRECATE_EOF the rows end with an OK packet that has a 0xFE header
+			_, _, statusFlags := parseOKPacket(payload)
+			return true, completeResultSet(pendingCommand, connectionState, statusFlags)
+
+		default:
+			pendingCommand.RowCount++
+			return true, false
 		}
 
-		if connectionState.ReceivedSimpleQuery && connectionState.EOFCount == 2 {
-			heartbeat.CompleteCurrentQuery(connectionState.CurrentQuery, connectionState.RowCount)
-			connectionState.EOFCount = 0
+	case types.ResponseStatePrepareDefinitions:
+		if isEOFPacket(payload) {
+			// separates the parameter and column definitions
+			return true, false
 		}
-		connectionState.RowCount = 0
 
-	case MysqlPacketTypeColumnDefinition, MysqlPacketTypeHandshake, MysqlPacketTypeHandshakeResponse, MysqlPacketTypeComFieldList:
-		break
+		pendingCommand.RemainingDefinitions--
+		if pendingCommand.RemainingDefinitions <= 0 {
+			if connectionState.ClientCapabilities&CLIENT_DEPRECATE_EOF != 0 {
+				// there's no trailing EOF, the response is complete
+				return true, true
+			}
+			pendingCommand.State = types.ResponseStatePrepareTrailingEOF
+		}
+		return true, false
 
-	default:
-		if connectionState.ReceivedSimpleQuery {
-			connectionState.RowCount++
+	case types.ResponseStatePrepareTrailingEOF:
+		if isEOFPacket(payload) {
+			return true, true
 		}
 
+		// CLIENT_DEPRECATE_EOF without having seen the handshake response,
+		// this packet belongs to the next command
+		return false, true
+
+	case types.ResponseStateFieldList:
+		if packetType == MysqlPacketTypeERRPacket || isEOFPacket(payload) {
+			return true, true
+		}
+		return true, false
 	}
 
-	return nil
+	return true, true
+}
+
+// handlePrepareOK records the statement id assigned by the server and returns
+// true if there are no parameter or column definitions to follow
+func handlePrepareOK(payload []byte, pendingCommand *types.PendingCommand, connectionState *types.ConnectionState) bool {
+	if len(payload) < 9 {
+		return true
+	}
+
+	stmtID := binary.LittleEndian.Uint32(payload[1:5])
+	columnCount := int(binary.LittleEndian.Uint16(payload[5:7]))
+	paramCount := int(binary.LittleEndian.Uint16(payload[7:9]))
+
+	connectionState.PreparedStatements[stmtID] = &types.PreparedStatement{
+		ID:          stmtID,
+		Query:       pendingCommand.PrepareQuery,
+		ParamCount:  paramCount,
+		ColumnCount: columnCount,
+	}
+
+	pendingCommand.RemainingDefinitions = paramCount + columnCount
+	if pendingCommand.RemainingDefinitions == 0 {
+		return true
+	}
+
+	pendingCommand.State = types.ResponseStatePrepareDefinitions
+	return false
+}
+
+// completeResultSet handles the end of a result set and returns true when
+// there are no more result sets to follow for the command
+func completeResultSet(pendingCommand *types.PendingCommand, connectionState *types.ConnectionState, statusFlags uint16) bool {
+	if statusFlags&SERVER_MORE_RESULTS_EXISTS != 0 {
+		pendingCommand.State = types.ResponseStateFirstPacket
+		return false
+	}
+
+	completeCommand(pendingCommand, connectionState, statusFlags)
+	return true
+}
+
+// isEOFPacket returns true for an EOF packet. the OK packet that replaces it
+// with CLIENT_DEPRECATE_EOF shares the 0xFE header but is always longer
+func isEOFPacket(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == MysqlPacketTypeEOFPacket && len(payload) <= 5
+}
+
+// parseOKPacket returns the affected rows, last insert id and status flags
+func parseOKPacket(payload []byte) (uint64, uint64, uint16) {
+	data := payload[1:]
+
+	affectedRows, n := readLengthEncodedInteger(data)
+	data = data[n:]
+
+	lastInsertID, n := readLengthEncodedInteger(data)
+	data = data[n:]
+
+	if len(data) < 2 {
+		return affectedRows, lastInsertID, 0
+	}
+
+	return affectedRows, lastInsertID, binary.LittleEndian.Uint16(data[0:2])
+}
+
+// parseERRPacket returns the error number, sql state and message
+func parseERRPacket(payload []byte) heartbeattypes.QueryPlanQueryError {
+	queryError := heartbeattypes.QueryPlanQueryError{}
+	if len(payload) < 3 {
+		return queryError
+	}
+
+	queryError.ErrorCode = int(binary.LittleEndian.Uint16(payload[1:3]))
+	data := payload[3:]
+
+	// the sql state marker is only present with CLIENT_PROTOCOL_41
+	if len(data) >= 6 && data[0] == '#' {
+		queryError.SQLState = string(data[1:6])
+		data = data[6:]
+	}
+
+	queryError.Message = string(data)
+	return queryError
+}
+
+// parseEOFPacket returns the warning count and status flags
+func parseEOFPacket(payload []byte) (uint16, uint16) {
+	if len(payload) < 5 {
+		return 0, 0
+	}
+
+	return binary.LittleEndian.Uint16(payload[1:3]), binary.LittleEndian.Uint16(payload[3:5])
+}
+
+// readLengthEncodedInteger returns the value and the number of bytes it used
+func readLengthEncodedInteger(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+
+	switch data[0] {
+	case 0xFC:
+		if len(data) < 3 {
+			return 0, len(data)
+		}
+		return uint64(binary.LittleEndian.Uint16(data[1:3])), 3
+	case 0xFD:
+		if len(data) < 4 {
+			return 0, len(data)
+		}
+		return uint64(data[1]) | uint64(data[2])<<8 | uint64(data[3])<<16, 4
+	case 0xFE:
+		if len(data) < 9 {
+			return 0, len(data)
+		}
+		return binary.LittleEndian.Uint64(data[1:9]), 9
+	default:
+		return uint64(data[0]), 1
+	}
 }
@@ -0,0 +1,346 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
+)
+
+func okPacket(affectedRows byte, statusFlags uint16) []byte {
+	payload := []byte{MysqlPacketTypeOKPacket, affectedRows, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(payload[3:5], statusFlags)
+	return payload
+}
+
+func eofPacket(statusFlags uint16) []byte {
+	payload := []byte{MysqlPacketTypeEOFPacket, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(payload[3:5], statusFlags)
+	return payload
+}
+
+// deprecateEOFOKPacket is the OK packet that ends a result set when the
+// client sets CLIENT_DEPRECATE_EOF
+func deprecateEOFOKPacket(statusFlags uint16) []byte {
+	payload := okPacket(0, statusFlags)
+	payload[0] = MysqlPacketTypeEOFPacket
+	return payload
+}
+
+func errPacket(code uint16, sqlState string, message string) []byte {
+	payload := []byte{MysqlPacketTypeERRPacket, 0, 0}
+	binary.LittleEndian.PutUint16(payload[1:3], code)
+	payload = append(payload, '#')
+	payload = append(payload, sqlState...)
+	return append(payload, message...)
+}
+
+func prepareOKPacket(stmtID uint32, columnCount uint16, paramCount uint16) []byte {
+	payload := make([]byte, 12)
+	binary.LittleEndian.PutUint32(payload[1:5], stmtID)
+	binary.LittleEndian.PutUint16(payload[5:7], columnCount)
+	binary.LittleEndian.PutUint16(payload[7:9], paramCount)
+	return payload
+}
+
+func columnCountPacket(count byte) []byte {
+	return []byte{count}
+}
+
+func columnDefinitionPacket() []byte {
+	return []byte{0x03, 'd', 'e', 'f', 0x00, 0x00, 0x00, 0x02, 'i', 'd'}
+}
+
+func rowPacket() []byte {
+	return []byte{0x01, '1'}
+}
+
+func queryCommand(query string) []byte {
+	return append([]byte{COM_QUERY}, query...)
+}
+
+func prepareCommand(query string) []byte {
+	return append([]byte{COM_STMT_PREPARE}, query...)
+}
+
+func executeCommand(stmtID uint32) []byte {
+	payload := make([]byte, 10)
+	payload[0] = COM_STMT_EXECUTE
+	binary.LittleEndian.PutUint32(payload[1:5], stmtID)
+	return payload
+}
+
+func closeCommand(stmtID uint32) []byte {
+	payload := make([]byte, 5)
+	payload[0] = COM_STMT_CLOSE
+	binary.LittleEndian.PutUint32(payload[1:5], stmtID)
+	return payload
+}
+
+// exchange is a payload from the client, or from the server when response is set
+type exchange struct {
+	payload  []byte
+	response bool
+}
+
+func client(payload []byte) exchange {
+	return exchange{payload: payload}
+}
+
+func server(payloads ...[]byte) []exchange {
+	exchanges := []exchange{}
+	for _, payload := range payloads {
+		exchanges = append(exchanges, exchange{payload: payload, response: true})
+	}
+	return exchanges
+}
+
+func conversation(parts ...interface{}) []exchange {
+	exchanges := []exchange{}
+	for _, part := range parts {
+		switch p := part.(type) {
+		case exchange:
+			exchanges = append(exchanges, p)
+		case []exchange:
+			exchanges = append(exchanges, p...)
+		}
+	}
+	return exchanges
+}
+
+func authenticatedConnectionState(t *testing.T) *types.ConnectionState {
+	connectionState, err := types.NewConnectionState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectionState.IsAuthenticated = true
+	return connectionState
+}
+
+func TestPreparedStatements(t *testing.T) {
+	tests := []struct {
+		name               string
+		clientCapabilities uint32
+		exchanges          []exchange
+		wantStatements     map[uint32]string
+		wantPending        int
+	}{
+		{
+			name: "prepare with definitions and trailing eof",
+			exchanges: conversation(
+				client(prepareCommand("select id from users where id = ?")),
+				server(prepareOKPacket(1, 1, 1), columnDefinitionPacket(), eofPacket(0), columnDefinitionPacket(), eofPacket(0)),
+			),
+			wantStatements: map[uint32]string{1: "select id from users where id = ?"},
+		},
+		{
+			name:               "pipelined prepares without eof",
+			clientCapabilities: CLIENT_DEPRECATE_EOF,
+			exchanges: conversation(
+				client(prepareCommand("select id from users where id = ?")),
+				client(prepareCommand("delete from users where id = ?")),
+				server(prepareOKPacket(1, 1, 1), columnDefinitionPacket(), columnDefinitionPacket()),
+				server(prepareOKPacket(2, 0, 1), columnDefinitionPacket()),
+			),
+			wantStatements: map[uint32]string{1: "select id from users where id = ?", 2: "delete from users where id = ?"},
+		},
+		{
+			name: "prepare without eof before the handshake response was seen",
+			exchanges: conversation(
+				client(prepareCommand("select id from users where id = ?")),
+				client(queryCommand("select 1")),
+				server(prepareOKPacket(1, 0, 1), columnDefinitionPacket()),
+				server(okPacket(0, SERVER_STATUS_AUTOCOMMIT)),
+			),
+			wantStatements: map[uint32]string{1: "select id from users where id = ?"},
+		},
+		{
+			name: "prepare without definitions",
+			exchanges: conversation(
+				client(prepareCommand("commit")),
+				server(prepareOKPacket(7, 0, 0)),
+			),
+			wantStatements: map[uint32]string{7: "commit"},
+		},
+		{
+			name: "failed prepare",
+			exchanges: conversation(
+				client(prepareCommand("select from")),
+				server(errPacket(1064, "42000", "You have an error in your SQL syntax")),
+			),
+			wantStatements: map[uint32]string{},
+		},
+		{
+			name:               "close",
+			clientCapabilities: CLIENT_DEPRECATE_EOF,
+			exchanges: conversation(
+				client(prepareCommand("select id from users where id = ?")),
+				server(prepareOKPacket(1, 0, 1), columnDefinitionPacket()),
+				client(prepareCommand("delete from users where id = ?")),
+				server(prepareOKPacket(2, 0, 1), columnDefinitionPacket()),
+				client(closeCommand(1)),
+			),
+			wantStatements: map[uint32]string{2: "delete from users where id = ?"},
+		},
+		{
+			name:               "execute waiting for its response",
+			clientCapabilities: CLIENT_DEPRECATE_EOF,
+			exchanges: conversation(
+				client(prepareCommand("select id from users where id = ?")),
+				server(prepareOKPacket(1, 1, 1), columnDefinitionPacket(), columnDefinitionPacket()),
+				client(executeCommand(1)),
+				server(columnCountPacket(1), columnDefinitionPacket(), rowPacket()),
+			),
+			wantStatements: map[uint32]string{1: "select id from users where id = ?"},
+			wantPending:    1,
+		},
+		{
+			name:               "reset connection",
+			clientCapabilities: CLIENT_DEPRECATE_EOF,
+			exchanges: conversation(
+				client(prepareCommand("select id from users where id = ?")),
+				server(prepareOKPacket(1, 0, 1), columnDefinitionPacket()),
+				client([]byte{COM_RESET_CONNECTION}),
+				server(okPacket(0, SERVER_STATUS_AUTOCOMMIT)),
+			),
+			wantStatements: map[uint32]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connectionState := authenticatedConnectionState(t)
+			connectionState.ClientCapabilities = test.clientCapabilities
+			replay(t, connectionState, test.exchanges)
+
+			statements := map[uint32]string{}
+			for id, statement := range connectionState.PreparedStatements {
+				statements[id] = statement.Query
+			}
+			if !reflect.DeepEqual(statements, test.wantStatements) {
+				t.Errorf("got statements %v; want %v", statements, test.wantStatements)
+			}
+			if len(connectionState.PendingCommands) != test.wantPending {
+				t.Errorf("got %d pending commands; want %d", len(connectionState.PendingCommands), test.wantPending)
+			}
+		})
+	}
+}
+
+func TestHandleResponsePacket(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      []byte
+		responses    [][]byte
+		wantDone     []bool
+		wantRowCount int64
+	}{
+		{
+			name:      "ok",
+			command:   queryCommand("update users set name = 'a'"),
+			responses: [][]byte{okPacket(3, SERVER_STATUS_AUTOCOMMIT)},
+			wantDone:  []bool{true},
+			// affected rows
+			wantRowCount: 3,
+		},
+		{
+			name:      "err",
+			command:   queryCommand("select * from missing"),
+			responses: [][]byte{errPacket(1146, "42S02", "Table 'db.missing' doesn't exist")},
+			wantDone:  []bool{true},
+		},
+		{
+			name:         "result set with eof",
+			command:      queryCommand("select id from users"),
+			responses:    [][]byte{columnCountPacket(1), columnDefinitionPacket(), eofPacket(0), rowPacket(), rowPacket(), eofPacket(SERVER_STATUS_AUTOCOMMIT)},
+			wantDone:     []bool{false, false, false, false, false, true},
+			wantRowCount: 2,
+		},
+		{
+			name:         "result set with deprecated eof",
+			command:      queryCommand("select id from users"),
+			responses:    [][]byte{columnCountPacket(1), columnDefinitionPacket(), rowPacket(), deprecateEOFOKPacket(SERVER_STATUS_AUTOCOMMIT)},
+			wantDone:     []bool{false, false, false, true},
+			wantRowCount: 1,
+		},
+		{
+			name:    "multiple result sets",
+			command: queryCommand("call get_users()"),
+			responses: [][]byte{
+				columnCountPacket(1), columnDefinitionPacket(), eofPacket(0), rowPacket(), eofPacket(SERVER_MORE_RESULTS_EXISTS),
+				okPacket(0, SERVER_STATUS_AUTOCOMMIT),
+			},
+			wantDone:     []bool{false, false, false, false, false, true},
+			wantRowCount: 1,
+		},
+		{
+			name:      "error part way through the rows",
+			command:   queryCommand("select id from users"),
+			responses: [][]byte{columnCountPacket(1), columnDefinitionPacket(), eofPacket(0), rowPacket(), errPacket(1317, "70100", "Query execution was interrupted")},
+			wantDone:  []bool{false, false, false, false, true},
+			// the row is still counted
+			wantRowCount: 1,
+		},
+		{
+			name:      "cursor",
+			command:   executeCommand(1),
+			responses: [][]byte{columnCountPacket(1), columnDefinitionPacket(), eofPacket(SERVER_STATUS_CURSOR_EXISTS)},
+			wantDone:  []bool{false, false, true},
+		},
+		{
+			name:      "field list",
+			command:   []byte{COM_FIELD_LIST, 'u', 's', 'e', 'r', 's', 0},
+			responses: [][]byte{columnDefinitionPacket(), columnDefinitionPacket(), eofPacket(0)},
+			wantDone:  []bool{false, false, true},
+		},
+		{
+			name:      "statistics",
+			command:   []byte{COM_STATISTICS},
+			responses: [][]byte{[]byte("Uptime: 5  Threads: 1")},
+			wantDone:  []bool{true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connectionState := authenticatedConnectionState(t)
+			inspectCommand(0, test.command, connectionState)
+			if len(connectionState.PendingCommands) != 1 {
+				t.Fatalf("got %d pending commands; want 1", len(connectionState.PendingCommands))
+			}
+			pendingCommand := connectionState.PendingCommands[0]
+
+			for i, response := range test.responses {
+				consumed, done := handleResponsePacket(response, pendingCommand, connectionState)
+				if !consumed {
+					t.Fatalf("response %d wasn't consumed", i)
+				}
+				if done != test.wantDone[i] {
+					t.Fatalf("response %d: got done %v; want %v", i, done, test.wantDone[i])
+				}
+			}
+
+			if pendingCommand.RowCount != test.wantRowCount {
+				t.Errorf("got row count %d; want %d", pendingCommand.RowCount, test.wantRowCount)
+			}
+		})
+	}
+}
+
+// replay feeds each payload to the command or response side, like the proxy
+// does after reassembling the packets
+func replay(t *testing.T, connectionState *types.ConnectionState, exchanges []exchange) {
+	t.Helper()
+
+	for _, e := range exchanges {
+		if e.response {
+			if err := parseFullResponsePacket(e.payload, connectionState); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		inspectCommand(0, e.payload, connectionState)
+	}
+}
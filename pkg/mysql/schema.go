@@ -1,112 +1,121 @@
 package mysql
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"time"
 
 	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/health"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat"
 	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/live"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
+)
+
+const (
+	minSchemaRetryDelay = 10 * time.Second
 )
 
 var (
 	Interval = 30 * time.Minute
 )
 
-func ProcessSchema(ctx context.Context, opts daemontypes.DaemonOpts) {
+// ProcessSchema uploads the schema every interval until the context is
+// cancelled, and right away when trigger receives. failures, like the
+// database being unreachable, are retried sooner with backoff
+func ProcessSchema(ctx context.Context, opts daemontypes.DaemonOpts, conn *live.Conn, trigger <-chan struct{}) {
+	interval := opts.SchemaInterval
+	if interval <= 0 {
+		interval = Interval
+	}
+
+	retryDelay := minSchemaRetryDelay
+
 	for {
-		if err := collectAndSendSchema(ctx, opts); err != nil {
-			log.Printf("Error in schema collection: %v", err)
-			time.Sleep(Interval)
-			continue
+		err := collectAndSendSchema(ctx, opts, conn)
+		health.RecordSchemaUpload(err)
+
+		wait := interval
+		if err != nil {
+			log.Printf("Error in schema collection: %v; retrying in %v", err, retryDelay)
+			wait = retryDelay
+			retryDelay = min(retryDelay*2, interval)
+		} else {
+			retryDelay = minSchemaRetryDelay
 		}
 
-		time.Sleep(Interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-trigger:
+			log.Printf("Collecting schema on demand")
+		}
 	}
 }
 
-func collectAndSendSchema(ctx context.Context, opts daemontypes.DaemonOpts) error {
-	tables, err := listTables(opts.LiveConnectionURI, opts.DatabaseName)
+func collectAndSendSchema(ctx context.Context, opts daemontypes.DaemonOpts, conn *live.Conn) error {
+	start := time.Now()
+
+	tables, err := listTables(ctx, conn, opts.DatabaseName)
 	if err != nil {
 		return fmt.Errorf("list tables: %v", err)
 	}
 
-	primaryKeys, err := listPrimaryKeys(opts.LiveConnectionURI, opts.DatabaseName)
+	primaryKeys, err := listPrimaryKeys(ctx, conn, opts.DatabaseName)
 	if err != nil {
 		return fmt.Errorf("list primary keys: %v", err)
 	}
 
-	for i, table := range tables {
-		if _, ok := primaryKeys[table.TableName]; !ok {
-			primaryKeys[table.TableName] = []string{}
-		}
-
-		tables[i].PrimaryKeys = primaryKeys[table.TableName]
-	}
-
-	payload := heartbeattypes.QueryPlanTablesPayload{
-		Tables: tables,
-	}
-
-	marshaled, err := json.Marshal(payload)
+	indexes, err := listIndexes(ctx, conn, opts.DatabaseName)
 	if err != nil {
-		return fmt.Errorf("marshal payload: %v", err)
+		return fmt.Errorf("list indexes: %v", err)
 	}
 
-	url := fmt.Sprintf("%s/v1/schema", opts.APIURL)
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(marshaled))
+	relationships, err := listRelationships(ctx, conn, opts.DatabaseName)
 	if err != nil {
-		return fmt.Errorf("create request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.Token))
-
-	if opts.Environment != "" {
-		req.Header.Set("X-QueryPlan-Environment", opts.Environment)
+		return fmt.Errorf("list relationships: %v", err)
 	}
 
-	req.Header.Set("X-QueryPlan-DBMS", string(daemontypes.Mysql))
-	req.Header.Set("X-QueryPlan-Database", opts.DatabaseName)
+	for i, table := range tables {
+		if _, ok := primaryKeys[table.TableName]; !ok {
+			primaryKeys[table.TableName] = []string{}
+		}
+		if _, ok := indexes[table.TableName]; !ok {
+			indexes[table.TableName] = []heartbeattypes.Index{}
+		}
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("send request: %v", err)
+		tables[i].PrimaryKeys = primaryKeys[table.TableName]
+		tables[i].Indexes = indexes[table.TableName]
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		// try to read the body
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("read body: %v", err)
-		}
+	metrics.SchemaCollectionDuration.WithLabelValues(string(daemontypes.Mysql)).Observe(time.Since(start).Seconds())
 
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	payload := heartbeattypes.QueryPlanTablesPayload{
+		Tables:        tables,
+		Relationships: relationships,
 	}
 
-	return nil
+	return heartbeat.SendSchema(ctx, opts, payload)
 }
 
-func listTables(uri string, dbName string) ([]heartbeattypes.Table, error) {
+func listTables(ctx context.Context, conn *live.Conn, dbName string) ([]heartbeattypes.Table, error) {
 	// read the schema from mysql
-	db, err := GetMysqlConnection(uri)
+	db, err := conn.DB()
 	if err != nil {
-		return nil, fmt.Errorf("get mysql connection: %v", err)
+		return nil, fmt.Errorf("get live connection: %v", err)
 	}
 
-	rows, err := db.Query(`SELECT
+	rows, err := db.QueryContext(ctx, `SELECT
 c.TABLE_NAME, c.COLUMN_NAME, c.DATA_TYPE, c.COLUMN_TYPE, c.IS_NULLABLE, c.COLUMN_KEY, c.COLUMN_DEFAULT, c.EXTRA,
-t.TABLE_ROWS
+t.TABLE_ROWS, t.DATA_LENGTH, t.INDEX_LENGTH
 FROM INFORMATION_SCHEMA.COLUMNS c
 INNER JOIN INFORMATION_SCHEMA.TABLES t ON t.TABLE_NAME = c.TABLE_NAME AND t.TABLE_SCHEMA = c.TABLE_SCHEMA
-WHERE c.TABLE_SCHEMA = ?`, dbName)
+WHERE c.TABLE_SCHEMA = ?
+ORDER BY c.TABLE_NAME, c.ORDINAL_POSITION`, dbName)
 	if err != nil {
 		return nil, fmt.Errorf("query schema: %v", err)
 	}
@@ -118,10 +127,13 @@ WHERE c.TABLE_SCHEMA = ?`, dbName)
 		column := heartbeattypes.Column{}
 
 		tableName := ""
-		estimatedRowCount := int64(0)
 		isNullable := ""
 		columnDefault := sql.NullString{}
-		if err := rows.Scan(&tableName, &column.ColumnName, &column.DataType, &column.ColumnType, &isNullable, &column.ColumnKey, &columnDefault, &column.Extra, &estimatedRowCount); err != nil {
+		// views don't have stats
+		estimatedRowCount := sql.NullInt64{}
+		dataSize := sql.NullInt64{}
+		indexSize := sql.NullInt64{}
+		if err := rows.Scan(&tableName, &column.ColumnName, &column.DataType, &column.ColumnType, &isNullable, &column.ColumnKey, &columnDefault, &column.Extra, &estimatedRowCount, &dataSize, &indexSize); err != nil {
 			return nil, fmt.Errorf("scan: %v", err)
 		}
 
@@ -146,7 +158,9 @@ WHERE c.TABLE_SCHEMA = ?`, dbName)
 			tables = append(tables, heartbeattypes.Table{
 				TableName:         tableName,
 				Columns:           []heartbeattypes.Column{column},
-				EstimatedRowCount: estimatedRowCount,
+				EstimatedRowCount: estimatedRowCount.Int64,
+				DataSizeBytes:     dataSize.Int64,
+				IndexSizeBytes:    indexSize.Int64,
 			})
 		}
 	}
@@ -154,13 +168,13 @@ WHERE c.TABLE_SCHEMA = ?`, dbName)
 	return tables, nil
 }
 
-func listPrimaryKeys(uri string, dbName string) (map[string][]string, error) {
-	db, err := GetMysqlConnection(uri)
+func listPrimaryKeys(ctx context.Context, conn *live.Conn, dbName string) (map[string][]string, error) {
+	db, err := conn.DB()
 	if err != nil {
-		return nil, fmt.Errorf("get mysql connection: %v", err)
+		return nil, fmt.Errorf("get live connection: %v", err)
 	}
 
-	rows, err := db.Query("SELECT TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME FROM  INFORMATION_SCHEMA.KEY_COLUMN_USAGE  WHERE  CONSTRAINT_NAME = 'PRIMARY' AND TABLE_SCHEMA = ? ORDER BY TABLE_NAME, ORDINAL_POSITION", dbName)
+	rows, err := db.QueryContext(ctx, "SELECT TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME FROM  INFORMATION_SCHEMA.KEY_COLUMN_USAGE  WHERE  CONSTRAINT_NAME = 'PRIMARY' AND TABLE_SCHEMA = ? ORDER BY TABLE_NAME, ORDINAL_POSITION", dbName)
 	if err != nil {
 		return nil, fmt.Errorf("query primary keys: %v", err)
 	}
@@ -184,3 +198,131 @@ func listPrimaryKeys(uri string, dbName string) (map[string][]string, error) {
 
 	return primaryKeys, nil
 }
+
+// listRelationships returns the foreign keys of the tables in the database,
+// with the columns in constraint order
+func listRelationships(ctx context.Context, conn *live.Conn, dbName string) ([]heartbeattypes.Relationship, error) {
+	db, err := conn.DB()
+	if err != nil {
+		return nil, fmt.Errorf("get live connection: %v", err)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT k.TABLE_NAME, k.CONSTRAINT_NAME, k.COLUMN_NAME,
+k.REFERENCED_TABLE_SCHEMA, k.REFERENCED_TABLE_NAME, k.REFERENCED_COLUMN_NAME, r.UPDATE_RULE, r.DELETE_RULE
+FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE k
+INNER JOIN INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS r ON r.CONSTRAINT_SCHEMA = k.CONSTRAINT_SCHEMA AND r.CONSTRAINT_NAME = k.CONSTRAINT_NAME AND r.TABLE_NAME = k.TABLE_NAME
+WHERE k.TABLE_SCHEMA = ? AND k.REFERENCED_TABLE_NAME IS NOT NULL
+ORDER BY k.TABLE_NAME, k.CONSTRAINT_NAME, k.ORDINAL_POSITION`, dbName)
+	if err != nil {
+		return nil, fmt.Errorf("query relationships: %v", err)
+	}
+
+	defer rows.Close()
+
+	relationships := []heartbeattypes.Relationship{}
+	for rows.Next() {
+		tableName := ""
+		constraintName := ""
+		columnName := ""
+		referencedSchemaName := ""
+		referencedTableName := ""
+		referencedColumnName := ""
+		updateRule := ""
+		deleteRule := ""
+		if err := rows.Scan(&tableName, &constraintName, &columnName, &referencedSchemaName, &referencedTableName, &referencedColumnName, &updateRule, &deleteRule); err != nil {
+			return nil, fmt.Errorf("scan: %v", err)
+		}
+
+		last := len(relationships) - 1
+		if last < 0 || relationships[last].TableName != tableName || relationships[last].ConstraintName != constraintName {
+			relationship := heartbeattypes.Relationship{
+				ConstraintName:      constraintName,
+				TableName:           tableName,
+				Columns:             []string{},
+				ReferencedTableName: referencedTableName,
+				ReferencedColumns:   []string{},
+				OnUpdate:            updateRule,
+				OnDelete:            deleteRule,
+			}
+
+			// tables in this database don't have a schema name, so only
+			// references to another database do
+			if referencedSchemaName != dbName {
+				relationship.ReferencedSchemaName = referencedSchemaName
+			}
+
+			relationships = append(relationships, relationship)
+			last++
+		}
+
+		relationships[last].Columns = append(relationships[last].Columns, columnName)
+		relationships[last].ReferencedColumns = append(relationships[last].ReferencedColumns, referencedColumnName)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read relationships: %v", err)
+	}
+
+	return relationships, nil
+}
+
+// listIndexes returns the indexes of each table, with the columns in index order
+func listIndexes(ctx context.Context, conn *live.Conn, dbName string) (map[string][]heartbeattypes.Index, error) {
+	db, err := conn.DB()
+	if err != nil {
+		return nil, fmt.Errorf("get live connection: %v", err)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT TABLE_NAME, INDEX_NAME, COLUMN_NAME, SUB_PART, NON_UNIQUE, INDEX_TYPE
+FROM INFORMATION_SCHEMA.STATISTICS
+WHERE TABLE_SCHEMA = ?
+ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`, dbName)
+	if err != nil {
+		return nil, fmt.Errorf("query indexes: %v", err)
+	}
+
+	defer rows.Close()
+
+	indexes := map[string][]heartbeattypes.Index{}
+	for rows.Next() {
+		tableName := ""
+		indexName := ""
+		columnName := sql.NullString{}
+		subPart := sql.NullInt64{}
+		nonUnique := 0
+		indexType := ""
+		if err := rows.Scan(&tableName, &indexName, &columnName, &subPart, &nonUnique, &indexType); err != nil {
+			return nil, fmt.Errorf("scan: %v", err)
+		}
+
+		// functional key parts don't have a column name
+		column := "(expression)"
+		if columnName.Valid {
+			column = columnName.String
+		}
+		if subPart.Valid {
+			column = fmt.Sprintf("%s(%d)", column, subPart.Int64)
+		}
+
+		tableIndexes := indexes[tableName]
+		if len(tableIndexes) == 0 || tableIndexes[len(tableIndexes)-1].IndexName != indexName {
+			tableIndexes = append(tableIndexes, heartbeattypes.Index{
+				IndexName: indexName,
+				Columns:   []string{},
+				IsUnique:  nonUnique == 0,
+				IsPrimary: indexName == "PRIMARY",
+				IndexType: indexType,
+			})
+		}
+
+		last := &tableIndexes[len(tableIndexes)-1]
+		last.Columns = append(last.Columns, column)
+		indexes[tableName] = tableIndexes
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read indexes: %v", err)
+	}
+
+	return indexes, nil
+}
@@ -0,0 +1,165 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
+)
+
+const (
+	CLIENT_SSL = 0x00000800
+
+	sslRequestPayloadSize = 32
+)
+
+var (
+	// handshakeTimeout bounds the handshake, so a client that stalls part
+	// way through can't hold the connection open forever
+	handshakeTimeout = 10 * time.Second
+)
+
+// negotiateTLS relays the start of the handshake, up to the point where the
+// client decides on TLS. when the client asks for it, the client side is
+// terminated with the proxy certificate and a separate TLS session is opened
+// to the upstream, so that the rest of the connection can be inspected.
+// without a proxy certificate the TLS session is passed through, and inspect
+// is false since the rest of the stream is opaque. the returned connections
+// should be used for everything after this
+func negotiateTLS(localConn net.Conn, targetConn net.Conn, serverTLSConfig *tls.Config, upstreamTLSConfig *tls.Config, connectionState *types.ConnectionState) (net.Conn, net.Conn, bool, error) {
+	// the deadlines also cover the tls handshakes, which run on these connections
+	deadline := time.Now().Add(handshakeTimeout)
+	if err := localConn.SetDeadline(deadline); err != nil {
+		return nil, nil, false, fmt.Errorf("set client deadline: %v", err)
+	}
+	defer localConn.SetDeadline(time.Time{})
+	if err := targetConn.SetDeadline(deadline); err != nil {
+		return nil, nil, false, fmt.Errorf("set upstream deadline: %v", err)
+	}
+	defer targetConn.SetDeadline(time.Time{})
+
+	handshake, err := readPacket(targetConn)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("read handshake: %v", err)
+	}
+
+	upstreamSupportsSSL := false
+	capabilityOffset := handshakeCapabilityOffset(handshake)
+	if capabilityOffset > 0 {
+		capabilities := binary.LittleEndian.Uint16(handshake[capabilityOffset : capabilityOffset+2])
+		upstreamSupportsSSL = capabilities&CLIENT_SSL != 0
+	}
+
+	// the handshake is relayed unchanged. tls is only offered to the client
+	// when the upstream offers it, since the client's SSLRequest has to be
+	// forwarded for the sequence ids to line up
+	if _, err := localConn.Write(handshake); err != nil {
+		return nil, nil, false, fmt.Errorf("write handshake: %v", err)
+	}
+
+	if capabilityOffset == 0 {
+		// an ERR instead of a handshake, the server is closing the connection
+		return localConn, targetConn, true, nil
+	}
+
+	response, err := readPacket(localConn)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("read handshake response: %v", err)
+	}
+
+	if !isSSLRequest(response) {
+		// this is the full handshake response, which the command side won't see
+		connectionState.Lock()
+		connectionState.ClientCapabilities = parseClientCapabilities(response[4:])
+		connectionState.Unlock()
+
+		if _, err := targetConn.Write(response); err != nil {
+			return nil, nil, false, fmt.Errorf("write handshake response: %v", err)
+		}
+		return localConn, targetConn, true, nil
+	}
+
+	// the client asked for tls without it being offered
+	if !upstreamSupportsSSL {
+		return nil, nil, false, fmt.Errorf("client requested tls but the upstream does not support it")
+	}
+
+	if _, err := targetConn.Write(response); err != nil {
+		return nil, nil, false, fmt.Errorf("write ssl request: %v", err)
+	}
+
+	if serverTLSConfig == nil {
+		// the tls handshake and everything after it go straight through
+		return localConn, targetConn, false, nil
+	}
+
+	upstreamTLSConn := tls.Client(targetConn, upstreamTLSConfig)
+	if err := upstreamTLSConn.Handshake(); err != nil {
+		return nil, nil, false, fmt.Errorf("upstream tls handshake: %v", err)
+	}
+
+	localTLSConn := tls.Server(localConn, serverTLSConfig)
+	if err := localTLSConn.Handshake(); err != nil {
+		upstreamTLSConn.Close()
+		return nil, nil, false, fmt.Errorf("client tls handshake: %v", err)
+	}
+
+	return localTLSConn, upstreamTLSConn, true, nil
+}
+
+// readPacket reads exactly one packet, without buffering anything past it,
+// so that the connection can be handed to a tls session afterwards
+func readPacket(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	payloadLength := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	packet := make([]byte, 4+payloadLength)
+	copy(packet, header)
+	if _, err := io.ReadFull(conn, packet[4:]); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// handshakeCapabilityOffset returns the offset of the lower capability flags
+// in an initial handshake packet, or 0 if this is not a handshake
+func handshakeCapabilityOffset(packet []byte) int {
+	if len(packet) < 5 || packet[4] != MysqlPacketTypeHandshake {
+		return 0
+	}
+
+	// protocol version, then the null terminated server version
+	offset := 5
+	for offset < len(packet) && packet[offset] != 0 {
+		offset++
+	}
+	offset++
+
+	// connection id (4), auth plugin data part 1 (8), filler (1)
+	offset += 4 + 8 + 1
+	if offset+2 > len(packet) {
+		return 0
+	}
+
+	return offset
+}
+
+// isSSLRequest returns true when the client handshake response is the short
+// SSLRequest packet that precedes the tls handshake
+func isSSLRequest(packet []byte) bool {
+	payload := packet[4:]
+	if len(payload) != sslRequestPayloadSize {
+		return false
+	}
+
+	capabilities := binary.LittleEndian.Uint32(payload[0:4])
+	return capabilities&CLIENT_SSL != 0
+}
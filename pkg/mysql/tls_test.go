@@ -0,0 +1,235 @@
+package mysql
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
+)
+
+// packet frames a payload with the given sequence id
+func packet(sequenceID byte, payload []byte) []byte {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), sequenceID}
+	return append(header, payload...)
+}
+
+func handshakePacket(capabilities uint16) []byte {
+	payload := []byte{MysqlPacketTypeHandshake}
+	payload = append(payload, "8.0.36\x00"...)
+	// connection id, auth plugin data part 1 and the filler
+	payload = append(payload, make([]byte, 4+8+1)...)
+	payload = binary.LittleEndian.AppendUint16(payload, capabilities)
+	// character set, status flags, upper capabilities and the rest
+	payload = append(payload, make([]byte, 1+2+2+1+10+13)...)
+	return packet(0, payload)
+}
+
+func sslRequestPacket() []byte {
+	payload := make([]byte, sslRequestPayloadSize)
+	binary.LittleEndian.PutUint32(payload[0:4], CLIENT_PROTOCOL_41|CLIENT_SSL)
+	return packet(1, payload)
+}
+
+func handshakeResponsePacket(capabilities uint32) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, capabilities)
+	payload = append(payload, make([]byte, 28)...)
+	payload = append(payload, "user\x00"...)
+	return packet(1, payload)
+}
+
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+type negotiateResult struct {
+	local   net.Conn
+	target  net.Conn
+	inspect bool
+	err     error
+}
+
+// startNegotiateTLS runs negotiateTLS between a client pipe and an upstream pipe,
+// and returns the far ends of both for the test to play the client and upstream
+func startNegotiateTLS(t *testing.T, connectionState *types.ConnectionState, serverTLSConfig *tls.Config) (net.Conn, net.Conn, <-chan negotiateResult) {
+	t.Helper()
+
+	client, local := net.Pipe()
+	target, upstream := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+
+	result := make(chan negotiateResult, 1)
+	go func() {
+		l, u, inspect, err := negotiateTLS(local, target, serverTLSConfig, &tls.Config{InsecureSkipVerify: true}, connectionState)
+		result <- negotiateResult{l, u, inspect, err}
+	}()
+
+	return client, upstream, result
+}
+
+func TestNegotiateTLSPlainUpstream(t *testing.T) {
+	connectionState := authenticatedConnectionState(t)
+	client, upstream, result := startNegotiateTLS(t, connectionState, selfSignedTLSConfig(t))
+
+	go upstream.Write(handshakePacket(CLIENT_PROTOCOL_41))
+
+	handshake, err := readPacket(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := handshakeCapabilityOffset(handshake)
+	if binary.LittleEndian.Uint16(handshake[offset:offset+2])&CLIENT_SSL != 0 {
+		t.Fatalf("tls was offered to the client without the upstream supporting it")
+	}
+
+	// the client continues in plain text
+	go client.Write(handshakeResponsePacket(CLIENT_PROTOCOL_41 | CLIENT_COMPRESS))
+	if _, err := readPacket(upstream); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if connectionState.ClientCapabilities&CLIENT_COMPRESS == 0 {
+		t.Errorf("got client capabilities %x; want them read from the handshake response", connectionState.ClientCapabilities)
+	}
+}
+
+func TestNegotiateTLSTerminated(t *testing.T) {
+	client, upstream, result := startNegotiateTLS(t, authenticatedConnectionState(t), selfSignedTLSConfig(t))
+
+	go upstream.Write(handshakePacket(CLIENT_PROTOCOL_41 | CLIENT_SSL))
+	if _, err := readPacket(client); err != nil {
+		t.Fatal(err)
+	}
+
+	go client.Write(sslRequestPacket())
+	if _, err := readPacket(upstream); err != nil {
+		t.Fatal(err)
+	}
+
+	// both sides handshake at once, the proxy does the upstream one first
+	upstreamTLSConfig := selfSignedTLSConfig(t)
+	upstreamTLS := make(chan error, 1)
+	go func() {
+		upstreamTLS <- tls.Server(upstream, upstreamTLSConfig).Handshake()
+	}()
+	if err := tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-upstreamTLS; err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if _, ok := r.local.(*tls.Conn); !ok {
+		t.Errorf("got a %T client connection; want tls", r.local)
+	}
+	if _, ok := r.target.(*tls.Conn); !ok {
+		t.Errorf("got a %T upstream connection; want tls", r.target)
+	}
+	if !r.inspect {
+		t.Errorf("got inspect false; want the terminated session to be inspected")
+	}
+}
+
+func TestNegotiateTLSPassthrough(t *testing.T) {
+	client, upstream, result := startNegotiateTLS(t, authenticatedConnectionState(t), nil)
+
+	go upstream.Write(handshakePacket(CLIENT_PROTOCOL_41 | CLIENT_SSL))
+	handshake, err := readPacket(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := handshakeCapabilityOffset(handshake)
+	if binary.LittleEndian.Uint16(handshake[offset:offset+2])&CLIENT_SSL == 0 {
+		t.Fatalf("tls offered by the upstream wasn't relayed to the client")
+	}
+
+	go client.Write(sslRequestPacket())
+	if _, err := readPacket(upstream); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.inspect {
+		t.Fatalf("got inspect true; want the tls session passed through")
+	}
+
+	// the tls handshake goes end to end, through an uninspected copy
+	go copyAndInspectCommands(r.local, r.target, authenticatedConnectionState(t), r.inspect)
+	go copyAndInspectResponses(r.target, r.local, authenticatedConnectionState(t), r.inspect)
+
+	upstreamTLSConfig := selfSignedTLSConfig(t)
+	upstreamTLS := make(chan error, 1)
+	go func() {
+		upstreamTLS <- tls.Server(upstream, upstreamTLSConfig).Handshake()
+	}()
+	if err := tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-upstreamTLS; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNegotiateTLSStalledClient(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 100 * time.Millisecond
+
+	client, upstream, result := startNegotiateTLS(t, authenticatedConnectionState(t), selfSignedTLSConfig(t))
+
+	go upstream.Write(handshakePacket(CLIENT_PROTOCOL_41 | CLIENT_SSL))
+	if _, err := readPacket(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client never sends its handshake response
+	select {
+	case r := <-result:
+		if r.err == nil || !strings.Contains(r.err.Error(), "read handshake response") {
+			t.Errorf("got error %v; want the handshake response read to time out", r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("negotiateTLS didn't time out")
+	}
+}
@@ -0,0 +1,55 @@
+package mysql
+
+import (
+	"strings"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat"
+	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/mysql/types"
+)
+
+const (
+	ER_LOCK_DEADLOCK = 1213
+)
+
+// completeCommand records the query for a command that succeeded, and follows
+// the transaction state from the status flags the server sent with it. the
+// caller must hold the connection state lock
+func completeCommand(pendingCommand *types.PendingCommand, connectionState *types.ConnectionState, statusFlags uint16) {
+	inTransaction := statusFlags&SERVER_STATUS_IN_TRANS != 0
+
+	// a transaction can start implicitly with autocommit off, so the query
+	// that started it belongs to it
+	if inTransaction && connectionState.CurrentTransaction == nil {
+		startedAt := time.Now().UnixNano()
+		if pendingCommand.Query != nil {
+			startedAt = pendingCommand.Query.ExecutionStartedAt
+		}
+		connectionState.CurrentTransaction = heartbeat.StartTransaction(startedAt)
+	}
+
+	heartbeat.CompleteCurrentQuery(pendingCommand.Query, connectionState.CurrentTransaction, pendingCommand.RowCount)
+
+	if !inTransaction && connectionState.CurrentTransaction != nil {
+		outcome := heartbeattypes.TransactionOutcomeCommit
+		if pendingCommand.Query != nil && strings.HasPrefix(strings.ToLower(pendingCommand.Query.Query), "rollback") {
+			outcome = heartbeattypes.TransactionOutcomeRollback
+		}
+
+		heartbeat.CompleteTransaction(connectionState.CurrentTransaction, outcome)
+		connectionState.CurrentTransaction = nil
+	}
+}
+
+// failCommand records the query for a command that returned an ERR. there are
+// no status flags on an ERR, but a deadlock always rolls back the transaction.
+// the caller must hold the connection state lock
+func failCommand(pendingCommand *types.PendingCommand, connectionState *types.ConnectionState, queryError heartbeattypes.QueryPlanQueryError) {
+	heartbeat.FailCurrentQuery(pendingCommand.Query, connectionState.CurrentTransaction, queryError)
+
+	if queryError.ErrorCode == ER_LOCK_DEADLOCK && connectionState.CurrentTransaction != nil {
+		heartbeat.CompleteTransaction(connectionState.CurrentTransaction, heartbeattypes.TransactionOutcomeRollback)
+		connectionState.CurrentTransaction = nil
+	}
+}
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"sync"
+
 	"github.com/pubnative/mysqlproto-go"
 	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
 	"github.com/tuvistavie/securerandom"
@@ -17,19 +19,69 @@ type COM_Query_TextResultsetPacket struct {
 }
 
 type PreparedStatement struct {
-	ID               int
-	Query            string
-	IsExecuted       bool
-	CountEOFReceived int
+	ID          uint32
+	Query       string
+	ParamCount  int
+	ColumnCount int
 }
 
+type ResponseState int
+
+const (
+	// ResponseStateFirstPacket is waiting for the first packet of the response,
+	// which decides if this is an OK, ERR or a result set
+	ResponseStateFirstPacket ResponseState = iota
+	ResponseStateColumnDefinitions
+	ResponseStateRows
+	ResponseStatePrepareDefinitions
+	ResponseStatePrepareTrailingEOF
+	ResponseStateFieldList
+)
+
+// PendingCommand is a command that has been sent upstream and is waiting
+// for its response. mysql answers commands in order, so the response being
+// read always belongs to the command at the head of the queue
+type PendingCommand struct {
+	Command byte
+
+	// Query is set for commands that we report, COM_QUERY and COM_STMT_EXECUTE
+	Query *heartbeattypes.CurrentQuery
+
+	// PrepareQuery is the statement text of a COM_STMT_PREPARE, it's moved
+	// to the prepared statements once the server assigns the statement id
+	PrepareQuery string
+
+	State                ResponseState
+	RemainingDefinitions int
+	SeenIntermediateEOF  bool
+	RowCount             int64
+}
+
+type CompressionAlgorithm int
+
+const (
+	CompressionNone CompressionAlgorithm = iota
+	CompressionZlib
+	CompressionZstd
+)
+
 type ConnectionState struct {
-	ID                  string
-	RowCount            int64
-	PreparedStatement   *PreparedStatement
-	ReceivedSimpleQuery bool
-	EOFCount            int
-	CurrentQuery        *heartbeattypes.CurrentQuery
+	sync.Mutex
+
+	ID                 string
+	PreparedStatements map[uint32]*PreparedStatement
+	PendingCommands    []*PendingCommand
+
+	// ClientCapabilities are the flags from the client handshake response
+	ClientCapabilities uint32
+	IsAuthenticated    bool
+
+	// Compression is set once authentication completes, if the client
+	// negotiated the compressed protocol
+	Compression CompressionAlgorithm
+
+	// CurrentTransaction is open while the server reports SERVER_STATUS_IN_TRANS
+	CurrentTransaction *heartbeattypes.CurrentTransaction
 }
 
 func NewConnectionState() (*ConnectionState, error) {
@@ -39,8 +91,8 @@ func NewConnectionState() (*ConnectionState, error) {
 	}
 
 	return &ConnectionState{
-		ID:                connectionID,
-		RowCount:          0,
-		PreparedStatement: nil,
+		ID:                 connectionID,
+		PreparedStatements: map[uint32]*PreparedStatement{},
+		PendingCommands:    []*PendingCommand{},
 	}, nil
 }
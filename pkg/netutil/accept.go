@@ -0,0 +1,61 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Accept waits for the next connection on the listener. errors that go away on
+// their own, like running out of file descriptors, are retried with backoff
+// instead of being returned
+func Accept(ctx context.Context, listener net.Listener) (net.Conn, error) {
+	delay := time.Duration(0)
+
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		if ctx.Err() != nil || !isTemporary(err) {
+			return nil, err
+		}
+
+		if delay == 0 {
+			delay = minAcceptDelay
+		} else if delay *= 2; delay > maxAcceptDelay {
+			delay = maxAcceptDelay
+		}
+
+		log.Printf("Temporary error accepting connection: %v; retrying in %v", err, delay)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func isTemporary(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
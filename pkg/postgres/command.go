@@ -1,6 +1,8 @@
 package postgres
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
@@ -8,15 +10,47 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
 	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres/types"
 )
 
 var (
-	ErrNonQueryData = fmt.Errorf("non-query data")
+	ErrNonQueryData             = fmt.Errorf("non-query data")
+	ErrIncompleteMessage        = fmt.Errorf("incomplete message")
+	ErrUnknownPreparedStatement = fmt.Errorf("unknown prepared statement")
+	ErrUnknownPortal            = fmt.Errorf("unknown portal")
+	ErrInvalidMessageLength     = fmt.Errorf("invalid message length")
+)
+
+// maxCommandLength bounds how much of a single frontend message is buffered for
+// inspection. longer messages, usually binds with large parameters, are still
+// forwarded but the connection is no longer inspected
+const maxCommandLength = 16 * 1024 * 1024
+
+type PostgresCommandType byte
+
+const (
+	PostgresCommandTypeQuery     = 'Q'
+	PostgresCommandTypeParse     = 'P'
+	PostgresCommandTypeBind      = 'B'
+	PostgresCommandTypeExecute   = 'E'
+	PostgresCommandTypeDescribe  = 'D'
+	PostgresCommandTypeClose     = 'C'
+	PostgresCommandTypeSync      = 'S'
+	PostgresCommandTypeFlush     = 'H'
+	PostgresCommandTypeTerminate = 'X'
 )
 
 func copyAndInspectCommand(src net.Conn, dst net.Conn, connectionState *types.ConnectionState, inspect bool) error {
+	if !inspect {
+		// the stream is opaque (tls passthrough or a cancel request), don't try to frame it
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	var accum bytes.Buffer
 	buffer := make([]byte, 4096)
 	for {
 		n, err := src.Read(buffer)
@@ -27,28 +61,46 @@ func copyAndInspectCommand(src net.Conn, dst net.Conn, connectionState *types.Co
 			break
 		}
 
-		data := buffer[:n]
-		if inspect {
-			query, isPreparedStatement, err := extractQuery(data)
-			if err == nil {
-				cleanedQuery, err := cleanQuery(query)
-				if err != nil {
-					log.Printf("Error cleaning query: %v", err)
-				} else {
-					connectionState.CurrentQuery = &heartbeattypes.CurrentQuery{
-						ExecutionStartedAt:  time.Now().UnixNano(),
-						Query:               cleanedQuery,
-						IsPreparedStatement: isPreparedStatement,
-					}
-				}
-			} else {
+		// messages are split and pipelined across reads, so they are framed
+		// from everything accumulated so far
+		accum.Write(buffer[:n])
+
+		// continue to read every possible complete message from accum
+		for {
+			data := accum.Bytes()
+			messageType, payload, count, ok, err := parseNextCommand(data)
+			if err != nil {
+				// the stream can't be framed anymore, so stop inspecting rather
+				// than guessing where the next message starts
+				log.Printf("Error framing command, no longer inspecting connection: %v", err)
+				metrics.ParseErrors.WithLabelValues(string(daemontypes.Postgres), "command").Inc()
+				inspect = false
+				accum.Reset()
+				break
+			}
+			if !ok {
+				break
+			}
+
+			if err := inspectCommand(messageType, payload, connectionState); err != nil {
 				if errors.Cause(err) != ErrNonQueryData {
 					log.Printf("Error extracting query: %v", err)
+					metrics.ParseErrors.WithLabelValues(string(daemontypes.Postgres), "command").Inc()
 				}
 			}
+
+			// remove this message from the buffer
+			accum.Next(count)
+		}
+
+		// forward only after inspecting, so the executions are queued before
+		// the backend can respond to them
+		if _, err = dst.Write(buffer[:n]); err != nil {
+			return err
 		}
 
-		if _, err = dst.Write(data); err != nil {
+		if !inspect {
+			_, err := io.Copy(dst, src)
 			return err
 		}
 	}
@@ -56,38 +108,188 @@ func copyAndInspectCommand(src net.Conn, dst net.Conn, connectionState *types.Co
 	return nil
 }
 
-func extractQuery(data []byte) (string, bool, error) {
-	// Check if we have at least a message type (1 byte) and length (4 bytes)
+// parseNextCommand returns the type and payload of the first complete frontend
+// message in data, and the total number of bytes it uses. an error is returned
+// when the header can't be a valid message, or the message is too long to inspect
+func parseNextCommand(data []byte) (byte, []byte, int, bool, error) {
 	if len(data) < 5 {
-		return "", false, fmt.Errorf("data too short to be a valid message")
+		return 0, nil, 0, false, nil
 	}
 
-	// The first byte is the message type
-	messageType := data[0]
-
-	// The next 4 bytes are the length of the message (big-endian)
-	messageLength := int(data[1])<<24 | int(data[2])<<16 | int(data[3])<<8 | int(data[4])
-
-	// Check if we have enough data for the full message
-	if len(data) < messageLength {
-		return "", false, fmt.Errorf("incomplete message")
+	messageLength := int(binary.BigEndian.Uint32(data[1:5]))
+	if messageLength < 4 {
+		return 0, nil, 0, false, errors.Wrapf(ErrInvalidMessageLength, "%c message with length %d", data[0], messageLength)
+	}
+	if messageLength > maxCommandLength {
+		return 0, nil, 0, false, errors.Wrapf(ErrInvalidMessageLength, "%c message with length %d exceeds %d", data[0], messageLength, maxCommandLength)
+	}
+	if len(data) < messageLength+1 {
+		return 0, nil, 0, false, nil
 	}
 
-	// Handle specific message types
+	return data[0], data[5 : messageLength+1], messageLength + 1, true, nil
+}
+
+// inspectCommand updates the connection state for a single frontend message.
+// payload is the message body, without the type byte and length
+func inspectCommand(messageType byte, payload []byte, connectionState *types.ConnectionState) error {
 	switch messageType {
-	case 'Q': // Simple query
-		query := string(data[5:messageLength])
-		return query, false, nil
+	case PostgresCommandTypeQuery:
+		query, _, err := readCString(payload)
+		if err != nil {
+			return errors.Wrap(err, "read query")
+		}
+
+		var currentQuery *heartbeattypes.CurrentQuery
+		cleanedQuery, err := cleanQuery(query)
+		if err != nil {
+			log.Printf("Error cleaning query: %v", err)
+		} else {
+			currentQuery = &heartbeattypes.CurrentQuery{
+				ExecutionStartedAt:  time.Now().UnixNano(),
+				Query:               cleanedQuery,
+				IsPreparedStatement: false,
+			}
+		}
+
+		connectionState.Lock()
+		defer connectionState.Unlock()
+
+		// a simple query destroys the unnamed statement and portal, and is
+		// always followed by a ReadyForQuery, just like a Sync
+		delete(connectionState.PreparedStatements, "")
+		delete(connectionState.Portals, "")
+		connectionState.PendingExecutions = append(connectionState.PendingExecutions,
+			&types.PendingExecution{Query: currentQuery},
+			&types.PendingExecution{IsSync: true},
+		)
+
+		return nil
+
+	case PostgresCommandTypeParse:
+		name, rest, err := readCString(payload)
+		if err != nil {
+			return errors.Wrap(err, "read statement name")
+		}
+		query, _, err := readCString(rest)
+		if err != nil {
+			return errors.Wrap(err, "read statement query")
+		}
+
+		// clean once here, rather than on every execute
+		cleanedQuery, err := cleanQuery(query)
+		if err != nil {
+			log.Printf("Error cleaning query: %v", err)
+			cleanedQuery = ""
+		}
+
+		connectionState.Lock()
+		defer connectionState.Unlock()
 
-	case 'P': // Parse (for prepared statements)
-		// Prepared statement message format:
-		// 'P' (1 byte), length (4 bytes), name (null-terminated), query (null-terminated), etc.
-		// For simplicity, we skip extracting the name here
-		query := string(data[5:messageLength])
-		return query, true, nil
+		connectionState.PreparedStatements[name] = &types.PreparedStatement{
+			Name:  name,
+			Query: cleanedQuery,
+		}
+
+		return nil
+
+	case PostgresCommandTypeBind:
+		portalName, rest, err := readCString(payload)
+		if err != nil {
+			return errors.Wrap(err, "read portal name")
+		}
+		statementName, _, err := readCString(rest)
+		if err != nil {
+			return errors.Wrap(err, "read statement name")
+		}
+
+		connectionState.Lock()
+		defer connectionState.Unlock()
+
+		statement, ok := connectionState.PreparedStatements[statementName]
+		if !ok {
+			delete(connectionState.Portals, portalName)
+			return errors.Wrapf(ErrUnknownPreparedStatement, "bind %q", statementName)
+		}
+
+		connectionState.Portals[portalName] = &types.Portal{
+			Name:      portalName,
+			Statement: statement,
+		}
+
+		return nil
+
+	case PostgresCommandTypeExecute:
+		portalName, _, err := readCString(payload)
+		if err != nil {
+			return errors.Wrap(err, "read portal name")
+		}
+
+		connectionState.Lock()
+		defer connectionState.Unlock()
+
+		// the execution is always queued, even when it can't be attributed,
+		// so that the backend responses stay aligned with the queue
+		pendingExecution := &types.PendingExecution{}
+		connectionState.PendingExecutions = append(connectionState.PendingExecutions, pendingExecution)
+
+		portal, ok := connectionState.Portals[portalName]
+		if !ok {
+			return errors.Wrapf(ErrUnknownPortal, "execute %q", portalName)
+		}
+
+		if portal.Statement.Query != "" {
+			pendingExecution.Query = &heartbeattypes.CurrentQuery{
+				ExecutionStartedAt:  time.Now().UnixNano(),
+				Query:               portal.Statement.Query,
+				IsPreparedStatement: true,
+			}
+		}
+
+		return nil
+
+	case PostgresCommandTypeClose:
+		if len(payload) < 1 {
+			return ErrIncompleteMessage
+		}
+		name, _, err := readCString(payload[1:])
+		if err != nil {
+			return errors.Wrap(err, "read close target")
+		}
+
+		connectionState.Lock()
+		defer connectionState.Unlock()
+
+		switch payload[0] {
+		case 'S':
+			delete(connectionState.PreparedStatements, name)
+		case 'P':
+			delete(connectionState.Portals, name)
+		}
+
+		return ErrNonQueryData
+
+	case PostgresCommandTypeSync:
+		connectionState.Lock()
+		defer connectionState.Unlock()
+
+		connectionState.PendingExecutions = append(connectionState.PendingExecutions, &types.PendingExecution{IsSync: true})
+
+		return ErrNonQueryData
 
 	default:
 		// Non-query message type
-		return "", false, ErrNonQueryData
+		return ErrNonQueryData
 	}
 }
+
+// readCString reads a null-terminated string from the start of data and
+// returns it along with the remaining bytes
+func readCString(data []byte) (string, []byte, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", nil, ErrIncompleteMessage
+	}
+
+	return string(data[:end]), data[end+1:], nil
+}
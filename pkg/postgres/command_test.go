@@ -0,0 +1,327 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres/types"
+)
+
+// message frames a frontend or backend message from its type and body
+func message(messageType byte, body ...[]byte) []byte {
+	payload := []byte{}
+	for _, b := range body {
+		payload = append(payload, b...)
+	}
+
+	data := []byte{messageType, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(data[1:5], uint32(len(payload)+4))
+	return append(data, payload...)
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func parse(name string, query string) []byte {
+	// no parameter types
+	return message(PostgresCommandTypeParse, cstring(name), cstring(query), []byte{0, 0})
+}
+
+func bind(portal string, statement string) []byte {
+	// no parameter formats, parameters or result formats
+	return message(PostgresCommandTypeBind, cstring(portal), cstring(statement), []byte{0, 0, 0, 0, 0, 0})
+}
+
+func execute(portal string) []byte {
+	return message(PostgresCommandTypeExecute, cstring(portal), []byte{0, 0, 0, 0})
+}
+
+func closeTarget(target byte, name string) []byte {
+	return message(PostgresCommandTypeClose, []byte{target}, cstring(name))
+}
+
+func syncMessage() []byte {
+	return message(PostgresCommandTypeSync)
+}
+
+func simpleQuery(query string) []byte {
+	return message(PostgresCommandTypeQuery, cstring(query))
+}
+
+// pendingSummary lists the pending executions as their queries, "-" for an
+// execution that couldn't be attributed and "SYNC" for a sync marker
+func pendingSummary(connectionState *types.ConnectionState) []string {
+	summary := []string{}
+	for _, pendingExecution := range connectionState.PendingExecutions {
+		switch {
+		case pendingExecution.IsSync:
+			summary = append(summary, "SYNC")
+		case pendingExecution.Query == nil:
+			summary = append(summary, "-")
+		default:
+			summary = append(summary, pendingExecution.Query.Query)
+		}
+	}
+	return summary
+}
+
+func TestParseNextCommand(t *testing.T) {
+	query := simpleQuery("select 1")
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantType    byte
+		wantPayload []byte
+		wantCount   int
+		wantOK      bool
+		wantErr     bool
+	}{
+		{
+			name: "empty",
+			data: []byte{},
+		},
+		{
+			name: "partial header",
+			data: query[:3],
+		},
+		{
+			name: "partial body",
+			data: query[:len(query)-1],
+		},
+		{
+			name:        "complete",
+			data:        query,
+			wantType:    'Q',
+			wantPayload: cstring("select 1"),
+			wantCount:   len(query),
+			wantOK:      true,
+		},
+		{
+			name:        "pipelined",
+			data:        append(append([]byte{}, query...), syncMessage()...),
+			wantType:    'Q',
+			wantPayload: cstring("select 1"),
+			wantCount:   len(query),
+			wantOK:      true,
+		},
+		{
+			name:        "no body",
+			data:        syncMessage(),
+			wantType:    'S',
+			wantPayload: []byte{},
+			wantCount:   5,
+			wantOK:      true,
+		},
+		{
+			name:    "length shorter than itself",
+			data:    []byte{'Q', 0, 0, 0, 2, 's', 'e', 'l'},
+			wantErr: true,
+		},
+		{
+			name:    "length over the limit",
+			data:    []byte{'Q', 0x7f, 0xff, 0xff, 0xff},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messageType, payload, count, ok, err := parseNextCommand(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v; want error %v", err, test.wantErr)
+			}
+			if ok != test.wantOK {
+				t.Fatalf("got ok %v; want %v", ok, test.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if messageType != test.wantType || count != test.wantCount || string(payload) != string(test.wantPayload) {
+				t.Errorf("got %c %q %d; want %c %q %d", messageType, payload, count, test.wantType, test.wantPayload, test.wantCount)
+			}
+		})
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	tests := []struct {
+		name           string
+		messages       [][]byte
+		wantPending    []string
+		wantStatements []string
+		wantPortals    []string
+		wantErr        error
+	}{
+		{
+			name:           "simple query",
+			messages:       [][]byte{parse("", "select 1"), simpleQuery("select name from accounts")},
+			wantPending:    []string{"select name from accounts", "SYNC"},
+			wantStatements: []string{},
+			wantPortals:    []string{},
+		},
+		{
+			name:           "unnamed extended query",
+			messages:       [][]byte{parse("", "select * from users where id = $1"), bind("", ""), execute(""), syncMessage()},
+			wantPending:    []string{"select * from users where id = ?", "SYNC"},
+			wantStatements: []string{""},
+			wantPortals:    []string{""},
+		},
+		{
+			name: "named statements and portals",
+			messages: [][]byte{
+				parse("s1", "select * from users where id = $1"),
+				parse("s2", "select name from accounts"),
+				bind("p2", "s2"),
+				bind("p1", "s1"),
+				execute("p1"),
+				execute("p2"),
+				syncMessage(),
+			},
+			wantPending:    []string{"select * from users where id = ?", "select name from accounts", "SYNC"},
+			wantStatements: []string{"s1", "s2"},
+			wantPortals:    []string{"p1", "p2"},
+		},
+		{
+			name:           "pipelined syncs",
+			messages:       [][]byte{parse("s1", "select name from accounts"), bind("", "s1"), execute(""), syncMessage(), execute(""), syncMessage()},
+			wantPending:    []string{"select name from accounts", "SYNC", "select name from accounts", "SYNC"},
+			wantStatements: []string{"s1"},
+			wantPortals:    []string{""},
+		},
+		{
+			name:           "execute unknown portal",
+			messages:       [][]byte{execute("missing")},
+			wantPending:    []string{"-"},
+			wantStatements: []string{},
+			wantPortals:    []string{},
+			wantErr:        ErrUnknownPortal,
+		},
+		{
+			name:           "bind closed statement",
+			messages:       [][]byte{parse("s1", "select name from accounts"), bind("p1", "s1"), closeTarget('S', "s1"), closeTarget('P', "p1"), bind("p1", "s1")},
+			wantPending:    []string{},
+			wantStatements: []string{},
+			wantPortals:    []string{},
+			wantErr:        ErrUnknownPreparedStatement,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connectionState, err := types.NewConnectionState()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lastErr error
+			for _, m := range test.messages {
+				messageType, payload, _, ok, err := parseNextCommand(m)
+				if err != nil || !ok {
+					t.Fatalf("message %q didn't parse", m)
+				}
+				lastErr = inspectCommand(messageType, payload, connectionState)
+			}
+
+			if test.wantErr != nil && errors.Cause(lastErr) != test.wantErr {
+				t.Errorf("got error %v; want %v", lastErr, test.wantErr)
+			}
+			if got := pendingSummary(connectionState); !reflect.DeepEqual(got, test.wantPending) {
+				t.Errorf("got pending %q; want %q", got, test.wantPending)
+			}
+			if got := sortedKeys(connectionState.PreparedStatements); !reflect.DeepEqual(got, test.wantStatements) {
+				t.Errorf("got statements %q; want %q", got, test.wantStatements)
+			}
+			if got := sortedKeys(connectionState.Portals); !reflect.DeepEqual(got, test.wantPortals) {
+				t.Errorf("got portals %q; want %q", got, test.wantPortals)
+			}
+		})
+	}
+}
+
+func TestCopyAndInspectCommandSplitReads(t *testing.T) {
+	stream := append(append(parse("", "select name from accounts"), bind("", "")...), append(execute(""), syncMessage()...)...)
+
+	// every split point, including inside the headers
+	for split := 1; split < len(stream); split++ {
+		connectionState, err := types.NewConnectionState()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		forwarded := inspectChunks(t, connectionState, stream[:split], stream[split:])
+		if string(forwarded) != string(stream) {
+			t.Fatalf("split at %d: forwarded %q; want %q", split, forwarded, stream)
+		}
+		if got, want := pendingSummary(connectionState), []string{"select name from accounts", "SYNC"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("split at %d: got pending %q; want %q", split, got, want)
+		}
+	}
+}
+
+func TestCopyAndInspectCommandInvalidLength(t *testing.T) {
+	connectionState, err := types.NewConnectionState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := [][]byte{simpleQuery("select 1"), {'Q', 0, 0, 0, 2}, simpleQuery("select 2")}
+	forwarded := inspectChunks(t, connectionState, chunks...)
+
+	// everything is still forwarded, but nothing after the bad header is inspected
+	if want := string(chunks[0]) + string(chunks[1]) + string(chunks[2]); string(forwarded) != want {
+		t.Errorf("forwarded %q; want %q", forwarded, want)
+	}
+	if got, want := pendingSummary(connectionState), []string{"select ?", "SYNC"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got pending %q; want %q", got, want)
+	}
+}
+
+// inspectChunks runs copyAndInspectCommand over a connection that delivers
+// each chunk as a separate read, and returns what was forwarded
+func inspectChunks(t *testing.T, connectionState *types.ConnectionState, chunks ...[]byte) []byte {
+	t.Helper()
+
+	client, src := net.Pipe()
+	dst, upstream := net.Pipe()
+
+	forwarded := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(upstream)
+		forwarded <- b
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- copyAndInspectCommand(src, dst, connectionState, true)
+	}()
+
+	for _, chunk := range chunks {
+		if _, err := client.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+
+	if err := <-done; err != nil && err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	dst.Close()
+
+	return <-forwarded
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres/types"
+)
+
+// the backend answers messages strictly in order, so the pending executions
+// are a fifo queue. the helpers below are called from the response side while
+// the command side appends to the queue
+
+// countPendingExecutionRow adds a data row to the execution at the head of the queue
+func countPendingExecutionRow(connectionState *types.ConnectionState) {
+	connectionState.Lock()
+	defer connectionState.Unlock()
+
+	if len(connectionState.PendingExecutions) == 0 {
+		return
+	}
+
+	head := connectionState.PendingExecutions[0]
+	if head.IsSync {
+		return
+	}
+
+	head.RowCount++
+}
+
+// popPendingExecution removes and returns the execution at the head of the queue.
+// nil is returned when the head is a sync marker, since that is only removed by
+// ReadyForQuery
+func popPendingExecution(connectionState *types.ConnectionState) *types.PendingExecution {
+	connectionState.Lock()
+	defer connectionState.Unlock()
+
+	if len(connectionState.PendingExecutions) == 0 {
+		return nil
+	}
+
+	head := connectionState.PendingExecutions[0]
+	if head.IsSync {
+		return nil
+	}
+
+	connectionState.PendingExecutions = connectionState.PendingExecutions[1:]
+	return head
+}
+
+// discardPendingExecutionsThroughSync drops everything up to and including the
+// first sync marker. after an error the backend skips every message until the
+// next Sync, so those executions will never complete
+func discardPendingExecutionsThroughSync(connectionState *types.ConnectionState) {
+	connectionState.Lock()
+	defer connectionState.Unlock()
+
+	for i, pendingExecution := range connectionState.PendingExecutions {
+		if pendingExecution.IsSync {
+			connectionState.PendingExecutions = connectionState.PendingExecutions[i+1:]
+			return
+		}
+	}
+
+	connectionState.PendingExecutions = connectionState.PendingExecutions[:0]
+}
@@ -0,0 +1,87 @@
+package postgres
+
+import (
+	"reflect"
+	"testing"
+
+	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres/types"
+)
+
+// pendingExecutions builds a queue from a summary, see pendingSummary
+func pendingExecutions(summary ...string) []*types.PendingExecution {
+	pending := []*types.PendingExecution{}
+	for _, s := range summary {
+		switch s {
+		case "SYNC":
+			pending = append(pending, &types.PendingExecution{IsSync: true})
+		case "-":
+			pending = append(pending, &types.PendingExecution{})
+		default:
+			pending = append(pending, &types.PendingExecution{Query: &heartbeattypes.CurrentQuery{Query: s}})
+		}
+	}
+	return pending
+}
+
+func TestDiscardPendingExecutionsThroughSync(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending []string
+		want    []string
+	}{
+		{
+			name:    "empty",
+			pending: []string{},
+			want:    []string{},
+		},
+		{
+			name:    "only the sync",
+			pending: []string{"SYNC"},
+			want:    []string{},
+		},
+		{
+			name:    "executions skipped after an error",
+			pending: []string{"select 2", "select 3", "SYNC", "select 4", "SYNC"},
+			want:    []string{"select 4", "SYNC"},
+		},
+		{
+			name:    "simple queries without a sync",
+			pending: []string{"select 1", "-"},
+			want:    []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connectionState := &types.ConnectionState{PendingExecutions: pendingExecutions(test.pending...)}
+
+			discardPendingExecutionsThroughSync(connectionState)
+
+			if got := pendingSummary(connectionState); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got pending %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPopPendingExecution(t *testing.T) {
+	connectionState := &types.ConnectionState{PendingExecutions: pendingExecutions("select 1", "SYNC")}
+
+	countPendingExecutionRow(connectionState)
+	countPendingExecutionRow(connectionState)
+
+	head := popPendingExecution(connectionState)
+	if head == nil || head.Query.Query != "select 1" || head.RowCount != 2 {
+		t.Fatalf("got %+v; want select 1 with 2 rows", head)
+	}
+
+	// the sync marker stays until ReadyForQuery
+	if head := popPendingExecution(connectionState); head != nil {
+		t.Errorf("got %+v; want nil at a sync marker", head)
+	}
+	countPendingExecutionRow(connectionState)
+	if got := pendingSummary(connectionState); !reflect.DeepEqual(got, []string{"SYNC"}) {
+		t.Errorf("got pending %q; want the sync marker", got)
+	}
+}
@@ -1,21 +1,17 @@
 package postgres
 
 import (
-	"context"
-	"database/sql"
-
-	"github.com/jackc/pgx/v5"
-)
-
-var (
-	DB *sql.DB
+	_ "github.com/jackc/pgx/v5/stdlib"
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/live"
 )
 
-func GetPostgresConnection(uri string) (*pgx.Conn, error) {
-	conn, err := pgx.Connect(context.Background(), uri)
-	if err != nil {
-		panic("failed to connect to Postgres: " + err.Error())
-	}
-
-	return conn, nil
+// OpenLiveConnection opens the pool that the schema is read with
+func OpenLiveConnection(opts daemontypes.DaemonOpts) (*live.Conn, error) {
+	return live.Open(live.Options{
+		DriverName:          "pgx",
+		URI:                 opts.LiveConnectionURI,
+		URIFile:             opts.LiveConnectionURIFile,
+		HealthCheckInterval: opts.LiveConnectionHealthCheckInterval,
+	})
 }
@@ -7,25 +7,49 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"strings"
 
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat"
+	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
 	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres/types"
 )
 
 type PostgresResponseType byte
 
 const (
-	PostgresResponseTypeRowDescription  = 'T'
-	PostgresResponseTypeDataRow         = 'D'
-	PostgresResponseTypeCommandComplete = 'C'
-	PostgresResponseTypeErrorResponse   = 'E'
-	PostgresResponseTypeAuthentication  = 'R'
-	PostgresResponseTypeParameterStatus = 'S'
-	PostgresResponseTypeReadyForQuery   = 'Z'
-	PostgresResponseTypeKeyData         = 'K'
+	PostgresResponseTypeRowDescription       = 'T'
+	PostgresResponseTypeDataRow              = 'D'
+	PostgresResponseTypeCommandComplete      = 'C'
+	PostgresResponseTypeErrorResponse        = 'E'
+	PostgresResponseTypeAuthentication       = 'R'
+	PostgresResponseTypeParameterStatus      = 'S'
+	PostgresResponseTypeReadyForQuery        = 'Z'
+	PostgresResponseTypeKeyData              = 'K'
+	PostgresResponseTypeParseComplete        = '1'
+	PostgresResponseTypeBindComplete         = '2'
+	PostgresResponseTypeCloseComplete        = '3'
+	PostgresResponseTypeNoData               = 'n'
+	PostgresResponseTypeParameterDescription = 't'
+	PostgresResponseTypeEmptyQueryResponse   = 'I'
+	PostgresResponseTypePortalSuspended      = 's'
+	PostgresResponseTypeNoticeResponse       = 'N'
+	PostgresResponseTypeNotification         = 'A'
+	PostgresResponseTypeCopyInResponse       = 'G'
+	PostgresResponseTypeCopyOutResponse      = 'H'
+	PostgresResponseTypeCopyBothResponse     = 'W'
+	PostgresResponseTypeCopyData             = 'd'
+	PostgresResponseTypeCopyDone             = 'c'
 )
 
 func copyAndInspectResponse(src net.Conn, dst net.Conn, connectionState *types.ConnectionState, inspect bool) error {
+	if !inspect {
+		// the stream is opaque (tls passthrough or a cancel request), don't try to frame it
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
 	var accum bytes.Buffer
 	buf := make([]byte, 8192)
 
@@ -50,7 +74,7 @@ func copyAndInspectResponse(src net.Conn, dst net.Conn, connectionState *types.C
 			messageType := PostgresResponseType(data[0])
 			messageLength := int(data[1])<<24 | int(data[2])<<16 | int(data[3])<<8 | int(data[4])
 
-			if len(data) < messageLength {
+			if len(data) < messageLength+1 {
 				break
 			}
 
@@ -66,27 +90,48 @@ func copyAndInspectResponse(src net.Conn, dst net.Conn, connectionState *types.C
 			switch messageType {
 			case PostgresResponseTypeRowDescription:
 				if len(data) < 7 {
+					metrics.ParseErrors.WithLabelValues(string(daemontypes.Postgres), "response").Inc()
 					return fmt.Errorf("incomplete row description message")
 				}
 			case PostgresResponseTypeDataRow:
+				countPendingExecutionRow(connectionState)
 			case PostgresResponseTypeCommandComplete:
 				commandTag := string(data[5:messageLength])
-				rowCount := int64(-1)
-				if len(commandTag) > 6 && commandTag[6] == ' ' {
-					rowCountPart := commandTag[7:] // "SELECT"
-					rowCountInt, err := strconv.Atoi(rowCountPart)
-					if err != nil {
-						log.Printf("Error parsing row count: %v", err)
-					}
-					rowCount = int64(rowCountInt)
+				pendingExecution := popPendingExecution(connectionState)
+				if pendingExecution != nil {
+					completeExecution(connectionState, pendingExecution, commandTag)
+				}
+			case PostgresResponseTypePortalSuspended:
+				// the execute hit its row limit, the client will issue another
+				// execute on the same portal for the rest
+				pendingExecution := popPendingExecution(connectionState)
+				if pendingExecution != nil {
+					heartbeat.CompleteCurrentQuery(pendingExecution.Query, connectionState.CurrentTransaction, pendingExecution.RowCount)
 				}
-				heartbeat.CompleteCurrentQuery(nil, rowCount)
+			case PostgresResponseTypeEmptyQueryResponse:
+				popPendingExecution(connectionState)
 			case PostgresResponseTypeErrorResponse:
 				log.Printf("Error in Response: %s", string(data[5:messageLength]))
-			case PostgresResponseTypeAuthentication, PostgresResponseTypeParameterStatus, PostgresResponseTypeReadyForQuery, PostgresResponseTypeKeyData:
+				pendingExecution := popPendingExecution(connectionState)
+				if pendingExecution != nil {
+					heartbeat.FailCurrentQuery(pendingExecution.Query, connectionState.CurrentTransaction, parseErrorResponse(data[5:messageLength+1]))
+				}
+			case PostgresResponseTypeReadyForQuery:
+				discardPendingExecutionsThroughSync(connectionState)
+				if messageLength >= 5 {
+					updateTransactionStatus(connectionState, data[5])
+				}
+			case PostgresResponseTypeAuthentication, PostgresResponseTypeParameterStatus, PostgresResponseTypeKeyData,
+				PostgresResponseTypeParseComplete, PostgresResponseTypeBindComplete, PostgresResponseTypeCloseComplete,
+				PostgresResponseTypeNoData, PostgresResponseTypeParameterDescription,
+				PostgresResponseTypeNoticeResponse, PostgresResponseTypeNotification,
+				PostgresResponseTypeCopyInResponse, PostgresResponseTypeCopyOutResponse, PostgresResponseTypeCopyBothResponse,
+				PostgresResponseTypeCopyData, PostgresResponseTypeCopyDone:
+				// a COPY ends with CommandComplete like any other command
 
 			default:
 				log.Printf("Unhandled response type: %c", messageType)
+				metrics.ParseErrors.WithLabelValues(string(daemontypes.Postgres), "unknown_message").Inc()
 			}
 
 			// remove this message from the buffer
@@ -96,3 +141,45 @@ func copyAndInspectResponse(src net.Conn, dst net.Conn, connectionState *types.C
 
 	}
 }
+
+// parseErrorResponse returns the sql state and message from the fields of an
+// ErrorResponse. each field is a type byte followed by a null terminated string
+func parseErrorResponse(payload []byte) heartbeattypes.QueryPlanQueryError {
+	queryError := heartbeattypes.QueryPlanQueryError{}
+
+	for len(payload) > 0 && payload[0] != 0 {
+		fieldType := payload[0]
+		value, rest, err := readCString(payload[1:])
+		if err != nil {
+			break
+		}
+
+		switch fieldType {
+		case 'C':
+			queryError.SQLState = value
+		case 'M':
+			queryError.Message = value
+		}
+
+		payload = rest
+	}
+
+	return queryError
+}
+
+// parseCommandTagRowCount returns the row count from a CommandComplete tag
+// such as "SELECT 5", "UPDATE 3" or "INSERT 0 1". Tags without a count,
+// like "CREATE TABLE", return false
+func parseCommandTagRowCount(commandTag string) (int64, bool) {
+	fields := strings.Fields(commandTag)
+	if len(fields) < 2 {
+		return 0, false
+	}
+
+	rowCount, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return rowCount, true
+}
@@ -1,174 +1,194 @@
 package postgres
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"regexp"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgtype"
 	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/health"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat"
 	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/live"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/metrics"
+)
+
+const (
+	minSchemaRetryDelay = 10 * time.Second
 )
 
 var (
 	Interval = 30 * time.Minute
 )
 
-func ProcessSchema(ctx context.Context, opts daemontypes.DaemonOpts) {
+// ProcessSchema uploads the schema every interval until the context is
+// cancelled, and right away when trigger receives. failures, like the
+// database being unreachable, are retried sooner with backoff
+func ProcessSchema(ctx context.Context, opts daemontypes.DaemonOpts, conn *live.Conn, trigger <-chan struct{}) {
+	interval := opts.SchemaInterval
+	if interval <= 0 {
+		interval = Interval
+	}
+
+	retryDelay := minSchemaRetryDelay
+
 	for {
-		if err := collectAndSendSchema(ctx, opts); err != nil {
-			log.Printf("Error in schema collection: %v", err)
-			time.Sleep(Interval)
-			continue
+		err := collectAndSendSchema(ctx, opts, conn)
+		health.RecordSchemaUpload(err)
+
+		wait := interval
+		if err != nil {
+			log.Printf("Error in schema collection: %v; retrying in %v", err, retryDelay)
+			wait = retryDelay
+			retryDelay = min(retryDelay*2, interval)
+		} else {
+			retryDelay = minSchemaRetryDelay
 		}
 
-		time.Sleep(Interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-trigger:
+			log.Printf("Collecting schema on demand")
+		}
 	}
 }
 
-func collectAndSendSchema(ctx context.Context, opts daemontypes.DaemonOpts) error {
-	tables, err := listTables(opts.LiveConnectionURI, opts.DatabaseName)
+func collectAndSendSchema(ctx context.Context, opts daemontypes.DaemonOpts, conn *live.Conn) error {
+	start := time.Now()
+
+	tables, err := listTables(ctx, conn, opts.DatabaseName, opts.PostgresSchemas)
 	if err != nil {
 		return fmt.Errorf("list tables: %v", err)
 	}
 
-	primaryKeys, err := listPrimaryKeys(opts.LiveConnectionURI, opts.DatabaseName)
+	constraints, err := listConstraints(ctx, conn, opts.PostgresSchemas)
 	if err != nil {
-		return fmt.Errorf("list primary keys: %v", err)
+		return fmt.Errorf("list constraints: %v", err)
 	}
 
-	for i, table := range tables {
-		if _, ok := primaryKeys[table.TableName]; !ok {
-			primaryKeys[table.TableName] = []string{}
-		}
-
-		tables[i].PrimaryKeys = primaryKeys[table.TableName]
-	}
-
-	payload := heartbeattypes.QueryPlanTablesPayload{
-		Tables: tables,
-	}
-
-	marshaled, err := json.Marshal(payload)
+	indexes, err := listIndexes(ctx, conn, opts.PostgresSchemas)
 	if err != nil {
-		return fmt.Errorf("marshal payload: %v", err)
+		return fmt.Errorf("list indexes: %v", err)
 	}
 
-	url := fmt.Sprintf("%s/v1/schema", opts.APIURL)
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(marshaled))
+	stats, err := listTableStats(ctx, conn, opts.PostgresSchemas)
 	if err != nil {
-		return fmt.Errorf("create request: %v", err)
+		return fmt.Errorf("list table stats: %v", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.Token))
+	for i, table := range tables {
+		key := tableKey(table.SchemaName, table.TableName)
+		if _, ok := constraints.primaryKeys[key]; !ok {
+			constraints.primaryKeys[key] = []string{}
+		}
+		if _, ok := indexes[key]; !ok {
+			indexes[key] = []heartbeattypes.Index{}
+		}
 
-	if opts.Environment != "" {
-		req.Header.Set("X-QueryPlan-Environment", opts.Environment)
+		tables[i].PrimaryKeys = constraints.primaryKeys[key]
+		tables[i].Indexes = indexes[key]
+		tables[i].UniqueConstraints = constraints.uniqueConstraints[key]
+		tables[i].EstimatedRowCount = stats[key].estimatedRowCount
+		tables[i].DataSizeBytes = stats[key].dataSize
+		tables[i].IndexSizeBytes = stats[key].indexSize
 	}
 
-	req.Header.Set("X-QueryPlan-DBMS", string(daemontypes.Postgres))
-	req.Header.Set("X-QueryPlan-Database", opts.DatabaseName)
+	metrics.SchemaCollectionDuration.WithLabelValues(string(daemontypes.Postgres)).Observe(time.Since(start).Seconds())
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("send request: %v", err)
+	payload := heartbeattypes.QueryPlanTablesPayload{
+		Tables:        tables,
+		Relationships: constraints.relationships,
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		// try to read the body
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("read body: %v", err)
-		}
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	return heartbeat.SendSchema(ctx, opts, payload)
+}
+
+// tableKey identifies a table across schemas
+func tableKey(schemaName string, tableName string) string {
+	return schemaName + "." + tableName
+}
+
+// schemaCondition returns a sql condition that limits column to the allowed
+// schemas, and the arguments it needs starting at $arg. without an allow list
+// every schema but the system ones is allowed
+func schemaCondition(column string, schemas []string, arg int) (string, []interface{}) {
+	if len(schemas) > 0 {
+		return fmt.Sprintf("%s = any($%d)", column, arg), []interface{}{schemas}
 	}
 
-	return nil
+	return fmt.Sprintf("%[1]s not in ('pg_catalog', 'information_schema') and %[1]s not like 'pg_toast%%' and %[1]s not like 'pg_temp_%%'", column), nil
 }
 
-func listTables(uri string, dbName string) ([]heartbeattypes.Table, error) {
+func listTables(ctx context.Context, conn *live.Conn, dbName string, schemas []string) ([]heartbeattypes.Table, error) {
 	// read the schema from postgres
-	db, err := GetPostgresConnection(uri)
+	db, err := conn.DB()
 	if err != nil {
-		return nil, fmt.Errorf("get postgres connection: %v", err)
+		return nil, fmt.Errorf("get live connection: %v", err)
 	}
 
-	rows, err := db.Query(context.TODO(), `select table_name from information_schema.tables where table_catalog = $1 and table_schema = $2`, dbName, "public")
+	condition, args := schemaCondition("table_schema", schemas, 2)
+	rows, err := db.QueryContext(ctx, `select table_schema, table_name, column_name, data_type, character_maximum_length, column_default, is_nullable
+from information_schema.columns
+where table_catalog = $1 and `+condition+`
+order by table_schema, table_name, ordinal_position`, append([]interface{}{dbName}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("query schema: %v", err)
+		return nil, fmt.Errorf("query columns: %v", err)
 	}
 	defer rows.Close()
 
-	tableNames := []string{}
+	tables := []heartbeattypes.Table{}
+	tableIndexes := map[string]int{}
 	for rows.Next() {
-		tableName := ""
-		if err := rows.Scan(&tableName); err != nil {
-			return nil, fmt.Errorf("scan: %v", err)
+		column := heartbeattypes.Column{}
+
+		var schemaName string
+		var tableName string
+		var maxLength sql.NullInt64
+		var isNullable string
+		var columnDefault sql.NullString
+
+		if err := rows.Scan(&schemaName, &tableName, &column.ColumnName, &column.DataType, &maxLength, &columnDefault, &isNullable); err != nil {
+			return nil, err
 		}
 
-		tableNames = append(tableNames, tableName)
-	}
+		if isNullable == "NO" {
+			column.IsNullable = false
+		} else {
+			column.IsNullable = true
+		}
 
-	rows.Close()
+		if columnDefault.Valid {
+			value := stripOIDClass(columnDefault.String)
+			column.ColumnDefault = &value
+		}
 
-	tables := []heartbeattypes.Table{}
-	for _, tableName := range tableNames {
-		rows, err = db.Query(context.TODO(), `select column_name, data_type, character_maximum_length, column_default, is_nullable from information_schema.columns where table_name = $1 and table_catalog = $2`, tableName, dbName)
-		if err != nil {
-			return nil, fmt.Errorf("query columns: %v", err)
+		if maxLength.Valid {
+			column.DataType = fmt.Sprintf("%s (%d)", column.DataType, maxLength.Int64)
 		}
 
-		defer rows.Close()
-		for rows.Next() {
-			column := heartbeattypes.Column{}
-
-			var maxLength sql.NullInt64
-			var isNullable string
-			var columnDefault sql.NullString
-
-			if err := rows.Scan(&column.ColumnName, &column.DataType, &maxLength, &columnDefault, &isNullable); err != nil {
-				return nil, err
-			}
-
-			if isNullable == "NO" {
-				column.IsNullable = false
-			} else {
-				column.IsNullable = true
-			}
-
-			if columnDefault.Valid {
-				value := stripOIDClass(columnDefault.String)
-				column.ColumnDefault = &value
-			}
-
-			if maxLength.Valid {
-				column.DataType = fmt.Sprintf("%s (%d)", column.DataType, maxLength.Int64)
-			}
-
-			found := false
-			for i, table := range tables {
-				if table.TableName == tableName {
-					tables[i].Columns = append(table.Columns, column)
-					found = true
-					continue
-				}
-			}
-
-			if !found {
-				tables = append(tables, heartbeattypes.Table{
-					TableName: tableName,
-					Columns:   []heartbeattypes.Column{column},
-				})
-			}
+		key := tableKey(schemaName, tableName)
+		i, ok := tableIndexes[key]
+		if !ok {
+			i = len(tables)
+			tableIndexes[key] = i
+			tables = append(tables, heartbeattypes.Table{
+				SchemaName: schemaName,
+				TableName:  tableName,
+				Columns:    []heartbeattypes.Column{},
+			})
 		}
+
+		tables[i].Columns = append(tables[i].Columns, column)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read columns: %v", err)
 	}
 
 	return tables, nil
@@ -184,33 +204,195 @@ func stripOIDClass(value string) string {
 	return value
 }
 
-func listPrimaryKeys(uri string, dbName string) (map[string][]string, error) {
-	db, err := GetPostgresConnection(uri)
+type tableStats struct {
+	estimatedRowCount int64
+	dataSize          int64
+	indexSize         int64
+}
+
+// listTableStats returns the row estimate and sizes of each table keyed by
+// tableKey. the data size includes toast, so data and index add up to
+// pg_total_relation_size
+func listTableStats(ctx context.Context, conn *live.Conn, schemas []string) (map[string]tableStats, error) {
+	db, err := conn.DB()
 	if err != nil {
-		return nil, fmt.Errorf("get postgres connection: %v", err)
+		return nil, fmt.Errorf("get live connection: %v", err)
 	}
 
-	rows, err := db.Query(context.TODO(), `select table_name, column_name from information_schema.key_column_usage where constraint_name = 'PRIMARY' and table_catalog = $1`, dbName)
+	// reltuples is -1 until the table is first vacuumed or analyzed
+	condition, args := schemaCondition("n.nspname", schemas, 1)
+	rows, err := db.QueryContext(ctx, `select n.nspname::text, c.relname::text, greatest(c.reltuples, 0)::bigint,
+pg_total_relation_size(c.oid) - pg_indexes_size(c.oid), pg_indexes_size(c.oid)
+from pg_class c
+join pg_namespace n on n.oid = c.relnamespace
+where c.relkind in ('r', 'p', 'm') and `+condition, args...)
 	if err != nil {
-		return nil, fmt.Errorf("query primary keys: %v", err)
+		return nil, fmt.Errorf("query table stats: %v", err)
 	}
 
 	defer rows.Close()
 
-	primaryKeys := map[string][]string{}
+	stats := map[string]tableStats{}
 	for rows.Next() {
+		var schemaName, tableName string
+		var s tableStats
+		if err := rows.Scan(&schemaName, &tableName, &s.estimatedRowCount, &s.dataSize, &s.indexSize); err != nil {
+			return nil, fmt.Errorf("scan: %v", err)
+		}
+
+		stats[tableKey(schemaName, tableName)] = s
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read table stats: %v", err)
+	}
+
+	return stats, nil
+}
+
+// constraints are the keys of every table, keyed by tableKey
+type constraints struct {
+	primaryKeys       map[string][]string
+	uniqueConstraints map[string][]heartbeattypes.UniqueConstraint
+	relationships     []heartbeattypes.Relationship
+}
+
+// referentialActions maps pg_constraint.confupdtype and confdeltype to their names
+var referentialActions = map[string]string{
+	"a": "NO ACTION",
+	"r": "RESTRICT",
+	"c": "CASCADE",
+	"n": "SET NULL",
+	"d": "SET DEFAULT",
+}
+
+// listConstraints reads the primary key, unique and foreign key constraints
+// from pg_constraint, with the columns in constraint order
+func listConstraints(ctx context.Context, conn *live.Conn, schemas []string) (*constraints, error) {
+	db, err := conn.DB()
+	if err != nil {
+		return nil, fmt.Errorf("get live connection: %v", err)
+	}
+
+	condition, args := schemaCondition("n.nspname", schemas, 1)
+	rows, err := db.QueryContext(ctx, `select n.nspname::text, t.relname::text, c.conname::text, c.contype::text,
+array(select a.attname::text from unnest(c.conkey) with ordinality as k(attnum, ord)
+  join pg_attribute a on a.attrelid = c.conrelid and a.attnum = k.attnum order by k.ord),
+rn.nspname::text, rt.relname::text,
+array(select a.attname::text from unnest(c.confkey) with ordinality as k(attnum, ord)
+  join pg_attribute a on a.attrelid = c.confrelid and a.attnum = k.attnum order by k.ord),
+c.confupdtype::text, c.confdeltype::text
+from pg_constraint c
+join pg_class t on t.oid = c.conrelid
+join pg_namespace n on n.oid = t.relnamespace
+left join pg_class rt on rt.oid = c.confrelid
+left join pg_namespace rn on rn.oid = rt.relnamespace
+where c.contype in ('p', 'u', 'f') and `+condition+`
+order by n.nspname, t.relname, c.conname`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query constraints: %v", err)
+	}
+
+	defer rows.Close()
+
+	// database/sql can't scan arrays on its own
+	typeMap := pgtype.NewMap()
+
+	result := &constraints{
+		primaryKeys:       map[string][]string{},
+		uniqueConstraints: map[string][]heartbeattypes.UniqueConstraint{},
+		relationships:     []heartbeattypes.Relationship{},
+	}
+	for rows.Next() {
+		var schemaName, tableName, constraintName, constraintType string
+		var columns, referencedColumns []string
+		var referencedSchemaName, referencedTableName sql.NullString
+		var onUpdate, onDelete string
+		if err := rows.Scan(&schemaName, &tableName, &constraintName, &constraintType, typeMap.SQLScanner(&columns),
+			&referencedSchemaName, &referencedTableName, typeMap.SQLScanner(&referencedColumns), &onUpdate, &onDelete); err != nil {
+			return nil, fmt.Errorf("scan: %v", err)
+		}
+
+		key := tableKey(schemaName, tableName)
+		switch constraintType {
+		case "p":
+			result.primaryKeys[key] = columns
+		case "u":
+			result.uniqueConstraints[key] = append(result.uniqueConstraints[key], heartbeattypes.UniqueConstraint{
+				ConstraintName: constraintName,
+				Columns:        columns,
+			})
+		case "f":
+			result.relationships = append(result.relationships, heartbeattypes.Relationship{
+				ConstraintName:       constraintName,
+				SchemaName:           schemaName,
+				TableName:            tableName,
+				Columns:              columns,
+				ReferencedSchemaName: referencedSchemaName.String,
+				ReferencedTableName:  referencedTableName.String,
+				ReferencedColumns:    referencedColumns,
+				OnUpdate:             referentialActions[onUpdate],
+				OnDelete:             referentialActions[onDelete],
+			})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read constraints: %v", err)
+	}
+
+	return result, nil
+}
+
+// listIndexes returns the indexes of each table keyed by tableKey. the key
+// columns are in index order, and expression indexes have the expression instead
+func listIndexes(ctx context.Context, conn *live.Conn, schemas []string) (map[string][]heartbeattypes.Index, error) {
+	db, err := conn.DB()
+	if err != nil {
+		return nil, fmt.Errorf("get live connection: %v", err)
+	}
+
+	condition, args := schemaCondition("n.nspname", schemas, 1)
+	rows, err := db.QueryContext(ctx, `select n.nspname, t.relname, i.relname, ix.indisunique, ix.indisprimary, am.amname,
+pg_get_expr(ix.indpred, ix.indrelid),
+array(select pg_get_indexdef(ix.indexrelid, k, true) from generate_series(1, ix.indnkeyatts) as k order by k)
+from pg_index ix
+join pg_class t on t.oid = ix.indrelid
+join pg_class i on i.oid = ix.indexrelid
+join pg_am am on am.oid = i.relam
+join pg_namespace n on n.oid = t.relnamespace
+where `+condition+`
+order by n.nspname, t.relname, i.relname`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query indexes: %v", err)
+	}
+
+	defer rows.Close()
+
+	// database/sql can't scan arrays on its own
+	typeMap := pgtype.NewMap()
+
+	indexes := map[string][]heartbeattypes.Index{}
+	for rows.Next() {
+		schemaName := ""
 		tableName := ""
-		columnName := ""
-		if err := rows.Scan(&tableName, &columnName); err != nil {
+		index := heartbeattypes.Index{}
+		predicate := sql.NullString{}
+		if err := rows.Scan(&schemaName, &tableName, &index.IndexName, &index.IsUnique, &index.IsPrimary, &index.IndexType, &predicate, typeMap.SQLScanner(&index.Columns)); err != nil {
 			return nil, fmt.Errorf("scan: %v", err)
 		}
 
-		if _, ok := primaryKeys[tableName]; !ok {
-			primaryKeys[tableName] = []string{}
+		if predicate.Valid {
+			index.Predicate = &predicate.String
 		}
 
-		primaryKeys[tableName] = append(primaryKeys[tableName], columnName)
+		key := tableKey(schemaName, tableName)
+		indexes[key] = append(indexes[key], index)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read indexes: %v", err)
 	}
 
-	return primaryKeys, nil
+	return indexes, nil
 }
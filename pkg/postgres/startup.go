@@ -0,0 +1,139 @@
+package postgres
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	cancelRequestCode   = 80877102
+	sslRequestCode      = 80877103
+	gssEncRequestCode   = 80877104
+	maxStartupPacketLen = 10000
+)
+
+var (
+	// startupTimeout bounds the startup, so a client that stalls part way
+	// through can't hold the connection open forever
+	startupTimeout = 10 * time.Second
+)
+
+// negotiateStartup handles the untyped messages at the start of a connection,
+// up to and including the StartupMessage. SSLRequest is answered with the proxy
+// certificate when one is configured, and a separate tls session is opened to
+// the upstream. the returned connections should be used for everything after
+// this, and inspect is false when the rest of the stream can't be parsed
+func negotiateStartup(localConn net.Conn, targetConn net.Conn, serverTLSConfig *tls.Config, upstreamTLSConfig *tls.Config) (net.Conn, net.Conn, bool, error) {
+	// the deadlines also cover the tls handshakes, which run on these connections
+	deadline := time.Now().Add(startupTimeout)
+	if err := localConn.SetDeadline(deadline); err != nil {
+		return nil, nil, false, fmt.Errorf("set client deadline: %v", err)
+	}
+	defer localConn.SetDeadline(time.Time{})
+	if err := targetConn.SetDeadline(deadline); err != nil {
+		return nil, nil, false, fmt.Errorf("set upstream deadline: %v", err)
+	}
+	defer targetConn.SetDeadline(time.Time{})
+
+	for {
+		packet, err := readStartupPacket(localConn)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("read startup packet: %v", err)
+		}
+
+		code := binary.BigEndian.Uint32(packet[4:8])
+
+		switch code {
+		case sslRequestCode:
+			if _, err := targetConn.Write(packet); err != nil {
+				return nil, nil, false, fmt.Errorf("write ssl request: %v", err)
+			}
+
+			upstreamResponse := make([]byte, 1)
+			if _, err := io.ReadFull(targetConn, upstreamResponse); err != nil {
+				return nil, nil, false, fmt.Errorf("read ssl response: %v", err)
+			}
+
+			if serverTLSConfig == nil {
+				// without a certificate, tls is passed through untouched
+				if _, err := localConn.Write(upstreamResponse); err != nil {
+					return nil, nil, false, fmt.Errorf("write ssl response: %v", err)
+				}
+				if upstreamResponse[0] == 'S' {
+					return localConn, targetConn, false, nil
+				}
+				continue
+			}
+
+			if upstreamResponse[0] != 'S' {
+				// the upstream refused, so the client gets the same answer
+				if _, err := localConn.Write(upstreamResponse); err != nil {
+					return nil, nil, false, fmt.Errorf("write ssl response: %v", err)
+				}
+				continue
+			}
+
+			upstreamTLSConn := tls.Client(targetConn, upstreamTLSConfig)
+			if err := upstreamTLSConn.Handshake(); err != nil {
+				return nil, nil, false, fmt.Errorf("upstream tls handshake: %v", err)
+			}
+			targetConn = upstreamTLSConn
+
+			if _, err := localConn.Write([]byte{'S'}); err != nil {
+				return nil, nil, false, fmt.Errorf("write ssl response: %v", err)
+			}
+
+			localTLSConn := tls.Server(localConn, serverTLSConfig)
+			if err := localTLSConn.Handshake(); err != nil {
+				return nil, nil, false, fmt.Errorf("client tls handshake: %v", err)
+			}
+			localConn = localTLSConn
+
+		case gssEncRequestCode:
+			// gss encryption can't be terminated here, declining makes the
+			// client fall back to ssl or plain text
+			if _, err := localConn.Write([]byte{'N'}); err != nil {
+				return nil, nil, false, fmt.Errorf("write gssenc response: %v", err)
+			}
+
+		case cancelRequestCode:
+			if _, err := targetConn.Write(packet); err != nil {
+				return nil, nil, false, fmt.Errorf("write cancel request: %v", err)
+			}
+			return localConn, targetConn, false, nil
+
+		default:
+			// StartupMessage, typed messages follow from here on
+			if _, err := targetConn.Write(packet); err != nil {
+				return nil, nil, false, fmt.Errorf("write startup message: %v", err)
+			}
+			return localConn, targetConn, true, nil
+		}
+	}
+}
+
+// readStartupPacket reads exactly one untyped startup packet, without
+// buffering anything past it, so the connection can be handed to tls
+func readStartupPacket(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header))
+	if length < 8 || length > maxStartupPacketLen {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+
+	packet := make([]byte, length)
+	copy(packet, header)
+	if _, err := io.ReadFull(conn, packet[4:]); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
@@ -0,0 +1,247 @@
+package postgres
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startupPacket(code uint32, body ...byte) []byte {
+	packet := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(packet[0:4], uint32(8+len(body)))
+	binary.BigEndian.PutUint32(packet[4:8], code)
+	return append(packet, body...)
+}
+
+func startupMessage() []byte {
+	// protocol 3.0 and a user parameter
+	return startupPacket(196608, []byte("user\x00postgres\x00\x00")...)
+}
+
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+type startupResult struct {
+	local   net.Conn
+	target  net.Conn
+	inspect bool
+	err     error
+}
+
+// startNegotiateStartup runs negotiateStartup between a client pipe and an
+// upstream pipe, and returns the far ends for the test to play both sides
+func startNegotiateStartup(t *testing.T, serverTLSConfig *tls.Config) (net.Conn, net.Conn, <-chan startupResult) {
+	t.Helper()
+
+	client, local := net.Pipe()
+	target, upstream := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+
+	result := make(chan startupResult, 1)
+	go func() {
+		l, u, inspect, err := negotiateStartup(local, target, serverTLSConfig, &tls.Config{InsecureSkipVerify: true})
+		result <- startupResult{l, u, inspect, err}
+	}()
+
+	return client, upstream, result
+}
+
+func readN(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNegotiateStartup(t *testing.T) {
+	tests := []struct {
+		name string
+		// upstreamSSL is the upstream's answer to an SSLRequest, 0 when none is sent
+		upstreamSSL byte
+		packets     [][]byte
+		wantReplies []byte
+		wantInspect bool
+	}{
+		{
+			name:        "startup message",
+			packets:     [][]byte{startupMessage()},
+			wantInspect: true,
+		},
+		{
+			name:        "ssl refused by the upstream",
+			upstreamSSL: 'N',
+			packets:     [][]byte{startupPacket(sslRequestCode), startupMessage()},
+			wantReplies: []byte{'N'},
+			wantInspect: true,
+		},
+		{
+			name:        "ssl passed through",
+			upstreamSSL: 'S',
+			packets:     [][]byte{startupPacket(sslRequestCode)},
+			wantReplies: []byte{'S'},
+			wantInspect: false,
+		},
+		{
+			name:        "gssenc declined",
+			packets:     [][]byte{startupPacket(gssEncRequestCode), startupMessage()},
+			wantReplies: []byte{'N'},
+			wantInspect: true,
+		},
+		{
+			name:        "cancel request",
+			packets:     [][]byte{startupPacket(cancelRequestCode, 0, 0, 0, 1, 0, 0, 0, 2)},
+			wantInspect: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, upstream, result := startNegotiateStartup(t, nil)
+
+			replies := []byte{}
+			for _, p := range test.packets {
+				if _, err := client.Write(p); err != nil {
+					t.Fatal(err)
+				}
+
+				code := binary.BigEndian.Uint32(p[4:8])
+				if code == gssEncRequestCode {
+					// answered by the proxy without involving the upstream
+					replies = append(replies, readN(t, client, 1)...)
+					continue
+				}
+
+				if forwarded := readN(t, upstream, len(p)); string(forwarded) != string(p) {
+					t.Fatalf("upstream got %q; want %q", forwarded, p)
+				}
+
+				if code == sslRequestCode {
+					if _, err := upstream.Write([]byte{test.upstreamSSL}); err != nil {
+						t.Fatal(err)
+					}
+					replies = append(replies, readN(t, client, 1)...)
+				}
+			}
+
+			r := <-result
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if string(replies) != string(test.wantReplies) {
+				t.Errorf("client got %q; want %q", replies, test.wantReplies)
+			}
+			if r.inspect != test.wantInspect {
+				t.Errorf("got inspect %v; want %v", r.inspect, test.wantInspect)
+			}
+		})
+	}
+}
+
+func TestNegotiateStartupTerminatesTLS(t *testing.T) {
+	client, upstream, result := startNegotiateStartup(t, selfSignedTLSConfig(t))
+
+	go client.Write(startupPacket(sslRequestCode))
+	readN(t, upstream, 8)
+	go upstream.Write([]byte{'S'})
+
+	// the proxy opens its own session to the upstream before answering the client
+	upstreamTLSConfig := selfSignedTLSConfig(t)
+	upstreamTLS := make(chan net.Conn, 1)
+	go func() {
+		conn := tls.Server(upstream, upstreamTLSConfig)
+		if err := conn.Handshake(); err != nil {
+			t.Error(err)
+		}
+		upstreamTLS <- conn
+	}()
+
+	if reply := readN(t, client, 1); reply[0] != 'S' {
+		t.Fatalf("client got %q; want S", reply)
+	}
+	clientTLS := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := clientTLS.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the startup message is read inside the tls session, and re-sent in the upstream one
+	go clientTLS.Write(startupMessage())
+	upstreamConn := <-upstreamTLS
+	if forwarded := readN(t, upstreamConn, len(startupMessage())); string(forwarded) != string(startupMessage()) {
+		t.Errorf("upstream got %q; want the startup message", forwarded)
+	}
+
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.inspect {
+		t.Errorf("got inspect false; want the terminated session to be inspected")
+	}
+}
+
+func TestNegotiateStartupStalledClient(t *testing.T) {
+	defer func(timeout time.Duration) { startupTimeout = timeout }(startupTimeout)
+	startupTimeout = 100 * time.Millisecond
+
+	client, _, result := startNegotiateStartup(t, nil)
+
+	// the client sends half a startup message and stops
+	go client.Write(startupMessage()[:6])
+
+	select {
+	case r := <-result:
+		if r.err == nil || !strings.Contains(r.err.Error(), "read startup packet") {
+			t.Errorf("got error %v; want the startup packet read to time out", r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("negotiateStartup didn't time out")
+	}
+}
+
+func TestReadStartupPacketInvalidLength(t *testing.T) {
+	client, local := net.Pipe()
+	defer client.Close()
+	defer local.Close()
+
+	go client.Write([]byte{0, 0, 0, 4})
+
+	if _, err := readStartupPacket(local); err == nil {
+		t.Errorf("got no error for a 4 byte startup packet")
+	}
+}
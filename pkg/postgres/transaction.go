@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"strings"
+	"time"
+
+	"github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat"
+	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres/types"
+)
+
+const (
+	transactionStatusIdle   = 'I'
+	transactionStatusActive = 'T'
+	transactionStatusFailed = 'E'
+)
+
+// recordTransaction hands a finished transaction to the heartbeat, tests replace it
+var recordTransaction = heartbeat.CompleteTransaction
+
+// the transaction state is only written from the response side, so unlike the
+// pending executions it doesn't need the connection state lock. the exception
+// is TransactionStatus, which is also read when draining connections
+
+// completeExecution records a query that ended with CommandComplete. the command
+// tag starts transactions, but only notes how they end, since "ROLLBACK TO
+// SAVEPOINT" has the same tag as ROLLBACK. the transaction ends when
+// ReadyForQuery reports the connection is idle
+func completeExecution(connectionState *types.ConnectionState, pendingExecution *types.PendingExecution, commandTag string) {
+	if commandTag == "BEGIN" || commandTag == "START TRANSACTION" {
+		if connectionState.CurrentTransaction != nil && connectionState.TransactionOutcome != "" {
+			// a pipelined batch can start another transaction before the
+			// ReadyForQuery that ends the previous one
+			completeTransaction(connectionState, connectionState.TransactionOutcome)
+		}
+		if connectionState.CurrentTransaction == nil {
+			connectionState.CurrentTransaction = heartbeat.StartTransaction(executionStartedAt(pendingExecution))
+		}
+	}
+
+	rowCount, ok := parseCommandTagRowCount(commandTag)
+	if !ok {
+		rowCount = pendingExecution.RowCount
+	}
+	heartbeat.CompleteCurrentQuery(pendingExecution.Query, connectionState.CurrentTransaction, rowCount)
+
+	// a COMMIT of a failed transaction reports ROLLBACK
+	if strings.HasPrefix(commandTag, "COMMIT") {
+		connectionState.TransactionOutcome = heartbeattypes.TransactionOutcomeCommit
+	} else if strings.HasPrefix(commandTag, "ROLLBACK") {
+		connectionState.TransactionOutcome = heartbeattypes.TransactionOutcomeRollback
+	}
+}
+
+// updateTransactionStatus follows the transaction status byte of ReadyForQuery,
+// which catches transactions that were not started or ended by a command tag
+func updateTransactionStatus(connectionState *types.ConnectionState, status byte) {
+	switch status {
+	case transactionStatusActive, transactionStatusFailed:
+		if connectionState.CurrentTransaction == nil {
+			connectionState.CurrentTransaction = heartbeat.StartTransaction(time.Now().UnixNano())
+		}
+	case transactionStatusIdle:
+		if connectionState.CurrentTransaction != nil {
+			outcome := connectionState.TransactionOutcome
+			if outcome == "" {
+				// ended without a command tag, like a failed implicit transaction
+				outcome = heartbeattypes.TransactionOutcomeCommit
+				if connectionState.TransactionStatus == transactionStatusFailed {
+					outcome = heartbeattypes.TransactionOutcomeRollback
+				}
+			}
+			completeTransaction(connectionState, outcome)
+		}
+	}
+
+	// still in a transaction, so the tag came from a savepoint
+	connectionState.TransactionOutcome = ""
+
+	connectionState.Lock()
+	connectionState.TransactionStatus = status
+	connectionState.Unlock()
+}
+
+func completeTransaction(connectionState *types.ConnectionState, outcome heartbeattypes.TransactionOutcome) {
+	if connectionState.CurrentTransaction == nil {
+		return
+	}
+
+	recordTransaction(connectionState.CurrentTransaction, outcome)
+	connectionState.CurrentTransaction = nil
+	connectionState.TransactionOutcome = ""
+}
+
+func executionStartedAt(pendingExecution *types.PendingExecution) int64 {
+	if pendingExecution.Query != nil {
+		return pendingExecution.Query.ExecutionStartedAt
+	}
+	return time.Now().UnixNano()
+}
@@ -0,0 +1,124 @@
+package postgres
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
+	"github.com/queryplan-ai/queryplan-proxy/pkg/postgres/types"
+)
+
+// transactionStep is a CommandComplete with its tag, or a ReadyForQuery when
+// status is set
+type transactionStep struct {
+	tag    string
+	status byte
+}
+
+func tag(commandTag string) transactionStep {
+	return transactionStep{tag: commandTag}
+}
+
+func readyForQuery(status byte) transactionStep {
+	return transactionStep{status: status}
+}
+
+func TestTransactionTracking(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []transactionStep
+		// wantOpen is whether a transaction is open after each step
+		wantOpen []bool
+		// wantOutcomes are the outcomes of the transactions that ended, with
+		// the number of queries in each. the heartbeat filters out BEGIN,
+		// COMMIT and ROLLBACK, so they aren't counted
+		wantOutcomes []string
+	}{
+		{
+			name:         "commit",
+			steps:        []transactionStep{tag("BEGIN"), tag("INSERT 0 1"), tag("COMMIT"), readyForQuery('I')},
+			wantOpen:     []bool{true, true, true, false},
+			wantOutcomes: []string{"commit 1"},
+		},
+		{
+			name: "rollback to savepoint then commit",
+			steps: []transactionStep{
+				tag("BEGIN"), tag("SAVEPOINT"), tag("INSERT 0 1"), tag("ROLLBACK"), readyForQuery('T'),
+				tag("COMMIT"), readyForQuery('I'),
+			},
+			wantOpen:     []bool{true, true, true, true, true, true, false},
+			wantOutcomes: []string{"commit 2"},
+		},
+		{
+			name:         "rollback to savepoint in the same batch as the commit",
+			steps:        []transactionStep{tag("BEGIN"), tag("SAVEPOINT"), tag("ROLLBACK"), tag("RELEASE"), tag("COMMIT"), readyForQuery('I')},
+			wantOpen:     []bool{true, true, true, true, true, false},
+			wantOutcomes: []string{"commit 2"},
+		},
+		{
+			name:         "rollback",
+			steps:        []transactionStep{tag("BEGIN"), tag("DELETE 2"), tag("ROLLBACK"), readyForQuery('I')},
+			wantOpen:     []bool{true, true, true, false},
+			wantOutcomes: []string{"rollback 1"},
+		},
+		{
+			name:         "commit of a failed transaction",
+			steps:        []transactionStep{tag("BEGIN"), readyForQuery('E'), tag("ROLLBACK"), readyForQuery('I')},
+			wantOpen:     []bool{true, true, true, false},
+			wantOutcomes: []string{"rollback 0"},
+		},
+		{
+			name:         "pipelined transactions",
+			steps:        []transactionStep{tag("BEGIN"), tag("COMMIT"), tag("BEGIN"), tag("ROLLBACK"), readyForQuery('I')},
+			wantOpen:     []bool{true, true, true, true, false},
+			wantOutcomes: []string{"commit 0", "rollback 0"},
+		},
+		{
+			name:         "failed without a command tag",
+			steps:        []transactionStep{readyForQuery('T'), readyForQuery('E'), readyForQuery('I')},
+			wantOpen:     []bool{true, true, false},
+			wantOutcomes: []string{"rollback 0"},
+		},
+		{
+			name:         "no transaction",
+			steps:        []transactionStep{tag("SELECT 1"), readyForQuery('I')},
+			wantOpen:     []bool{false, false},
+			wantOutcomes: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connectionState, err := types.NewConnectionState()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			outcomes := []string{}
+			defer func(record func(*heartbeattypes.CurrentTransaction, heartbeattypes.TransactionOutcome)) {
+				recordTransaction = record
+			}(recordTransaction)
+			recordTransaction = func(transaction *heartbeattypes.CurrentTransaction, outcome heartbeattypes.TransactionOutcome) {
+				outcomes = append(outcomes, fmt.Sprintf("%s %d", outcome, transaction.QueryCount))
+			}
+
+			for i, step := range test.steps {
+				if step.status != 0 {
+					updateTransactionStatus(connectionState, step.status)
+				} else {
+					query := &heartbeattypes.CurrentQuery{Query: step.tag}
+					completeExecution(connectionState, &types.PendingExecution{Query: query}, step.tag)
+				}
+
+				if open := connectionState.CurrentTransaction != nil; open != test.wantOpen[i] {
+					t.Fatalf("step %d: got open %v; want %v", i, open, test.wantOpen[i])
+				}
+			}
+
+			if !reflect.DeepEqual(outcomes, test.wantOutcomes) {
+				t.Errorf("got outcomes %q; want %q", outcomes, test.wantOutcomes)
+			}
+		})
+	}
+}
@@ -1,14 +1,50 @@
 package types
 
 import (
+	"sync"
+
 	heartbeattypes "github.com/queryplan-ai/queryplan-proxy/pkg/heartbeat/types"
 	"github.com/tuvistavie/securerandom"
 )
 
+// PreparedStatement is a statement created by a Parse message. The unnamed
+// statement is stored with an empty name.
+type PreparedStatement struct {
+	Name  string
+	Query string
+}
+
+// Portal is a statement bound to parameters by a Bind message. The unnamed
+// portal is stored with an empty name.
+type Portal struct {
+	Name      string
+	Statement *PreparedStatement
+}
+
+// PendingExecution is a query that has been sent upstream and is waiting
+// for the backend to complete it. Sync markers are queued too, so that a
+// ReadyForQuery can discard anything the backend skipped after an error.
+type PendingExecution struct {
+	Query    *heartbeattypes.CurrentQuery
+	IsSync   bool
+	RowCount int64
+}
+
 type ConnectionState struct {
-	ID           string
-	RowCount     int64
-	CurrentQuery *heartbeattypes.CurrentQuery
+	sync.Mutex
+
+	ID string
+
+	PreparedStatements map[string]*PreparedStatement
+	Portals            map[string]*Portal
+	PendingExecutions  []*PendingExecution
+
+	// TransactionStatus is the status byte from the last ReadyForQuery
+	TransactionStatus  byte
+	CurrentTransaction *heartbeattypes.CurrentTransaction
+	// TransactionOutcome is set from the COMMIT or ROLLBACK command tag, and
+	// used when the next ReadyForQuery reports the connection is idle
+	TransactionOutcome heartbeattypes.TransactionOutcome
 }
 
 func NewConnectionState() (*ConnectionState, error) {
@@ -18,7 +54,9 @@ func NewConnectionState() (*ConnectionState, error) {
 	}
 
 	return &ConnectionState{
-		ID:       connectionID,
-		RowCount: 0,
+		ID:                 connectionID,
+		PreparedStatements: map[string]*PreparedStatement{},
+		Portals:            map[string]*Portal{},
+		PendingExecutions:  []*PendingExecution{},
 	}, nil
 }
@@ -51,6 +51,25 @@ func (rb *RingBuffer[T]) GetAll() []T {
 	return out
 }
 
+// TakeAll returns all the entries in the ring buffer in the order they were
+// added, and empties it. Unlike GetAll followed by Clear, no item added
+// concurrently is lost.
+func (rb *RingBuffer[T]) TakeAll() []T {
+	if rb == nil {
+		return nil
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	out := make([]T, len(rb.buf))
+	for i := 0; i < len(rb.buf); i++ {
+		x := (rb.pos + i) % rb.max
+		out[i] = rb.buf[x]
+	}
+	rb.pos = 0
+	rb.buf = nil
+	return out
+}
+
 // Len returns the number of elements in the ring buffer. Note that this value
 // could change immediately after being returned if a concurrent caller
 // modifies the buffer.
@@ -42,6 +42,22 @@ func TestRingBuffer(t *testing.T) {
 		}
 	})
 
+	t.Run("TakeAll", func(t *testing.T) {
+		all := rb.TakeAll()
+		want := []int{1, 2, 3, 4, 5, 6, 7, 8, 98, 99}
+		if !reflect.DeepEqual(all, want) {
+			t.Fatalf("items mismatch\ngot: %v\nwant %v", all, want)
+		}
+		if ll := rb.Len(); ll != 0 {
+			t.Fatalf("got len %d; want 0", ll)
+		}
+
+		rb.Add(100)
+		if all := rb.GetAll(); !reflect.DeepEqual(all, []int{100}) {
+			t.Fatalf("items mismatch\ngot: %v\nwant %v", all, []int{100})
+		}
+	})
+
 	t.Run("Clear", func(t *testing.T) {
 		rb.Clear()
 		if ll := rb.Len(); ll != 0 {
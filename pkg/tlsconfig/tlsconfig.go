@@ -0,0 +1,62 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	daemontypes "github.com/queryplan-ai/queryplan-proxy/pkg/daemon/types"
+)
+
+// ServerConfig returns the tls config the proxy presents to clients, or nil
+// when no certificate is configured and tls should be passed through untouched
+func ServerConfig(opts daemontypes.DaemonOpts) (*tls.Config, error) {
+	if opts.TLSCertFile == "" && opts.TLSKeyFile == "" {
+		return nil, nil
+	}
+
+	if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+		return nil, fmt.Errorf("both tls cert file and tls key file are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load key pair: %v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// UpstreamConfig returns the tls config used when the proxy opens its own
+// tls session to the upstream database
+func UpstreamConfig(opts daemontypes.DaemonOpts) (*tls.Config, error) {
+	serverName := opts.UpstreamTLSServerName
+	if serverName == "" {
+		serverName = opts.UpstreamAddress
+	}
+
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: opts.UpstreamTLSSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if opts.UpstreamTLSCAFile != "" {
+		caCert, err := os.ReadFile(opts.UpstreamTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.UpstreamTLSCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}